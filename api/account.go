@@ -0,0 +1,547 @@
+package api
+
+import (
+	"archive/zip"
+	"crypto/sha512"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/badoux/checkmail"
+)
+
+const accountDeletionLinkTTL = time.Hour
+
+// signature returns a hex signature of values for the given link purpose.
+func (api *API) signature(purpose string, values ...string) string {
+	sum := sha512.Sum512_256([]byte(api.authSecret + purpose + "|" + strings.Join(values, "|")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (api *API) checkSignature(verify, purpose string, values ...string) bool {
+	return subtle.ConstantTimeCompare([]byte(verify), []byte(api.signature(purpose, values...))) == 1
+}
+
+// checkSignedTimestamp validates a signed link timestamp that's at most ttl old.
+func checkSignedTimestamp(ts string, ttl time.Duration) bool {
+	unixTs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	return !time.Unix(unixTs, 0).Before(time.Now().Add(-ttl))
+}
+
+func (api *API) HandleAPIPostAccountDelete(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	email := ""
+	err := api.db.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&email)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ts := fmt.Sprint(time.Now().Unix())
+	link := api.origin(r) + "/app/account/delete?" + url.Values{
+		"user":   []string{userID},
+		"ts":     []string{ts},
+		"verify": []string{api.signature("delete-account", ts, userID)},
+	}.Encode()
+
+	err = api.sendMail(email, emailDeleteAccount, DeleteAccountEmail{ConfirmURL: link})
+	if err != nil {
+		log.Println("error sending email", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	api.audit(r, userID, auditAccountDeleteRequest, "")
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+var accountDeletePage = template.Must(template.New("delete").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Delete account - ReadFaster.app</title><link rel="stylesheet" href="/landing.css"/></head>
+<body>
+<div class="rfa-container">
+<div class="rfa-landing-section">
+<h2>Delete your account?</h2>
+<p>This permanently deletes your account, reading sessions and Goodreads connection. It can't be undone.</p>
+<form method="POST">
+<input type="hidden" name="user" value="{{ .User }}"/>
+<input type="hidden" name="ts" value="{{ .Ts }}"/>
+<input type="hidden" name="verify" value="{{ .Verify }}"/>
+<button type="submit">Delete my account</button>
+</form>
+</div>
+</div>
+</body>
+</html>
+`))
+
+// HandleAccountDelete confirms an account deletion link. GET requests only
+// render a confirmation form so link scanners can't delete accounts.
+func (api *API) HandleAccountDelete(w http.ResponseWriter, r *http.Request) {
+	userID := r.FormValue("user")
+	ts := r.FormValue("ts")
+	verify := r.FormValue("verify")
+
+	if !api.checkSignature(verify, "delete-account", ts, userID) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Bad verify parameter.`))
+		return
+	}
+	if !checkSignedTimestamp(ts, accountDeletionLinkTTL) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Link expired.`))
+		return
+	}
+
+	if r.Method != "POST" {
+		accountDeletePage.Execute(w, map[string]string{
+			"User":   userID,
+			"Ts":     ts,
+			"Verify": verify,
+		})
+		return
+	}
+
+	err := api.deleteAccount(userID)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`Something went wrong.`))
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "rfa",
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Now(),
+		Secure:   !api.devMode,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Refresh", "3; /")
+	w.Write([]byte(`Your account has been deleted.`))
+}
+
+// deleteAccount deletes the user. Rows referencing the user are removed by
+// ON DELETE CASCADE, and rows keyed by the user's email addresses are
+// deleted here in the same transaction.
+func (api *API) deleteAccount(userID string) error {
+	tx, err := api.db.Begin()
+	if err != nil {
+		return err
+	}
+	email := ""
+	pendingEmail := ""
+	err = tx.QueryRow("DELETE FROM users WHERE id = $1 RETURNING email, COALESCE(pending_email, '')",
+		userID).Scan(&email, &pendingEmail)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	for _, query := range []string{
+		"DELETE FROM launch_subscribers WHERE lower(email) IN (lower($1), lower($2))",
+		"DELETE FROM email_suppressions WHERE email IN (lower($1), lower($2))",
+		"DELETE FROM email_events WHERE lower(recipient) IN (lower($1), lower($2))",
+		"DELETE FROM email_outbox WHERE lower(recipient) IN (lower($1), lower($2))",
+		"DELETE FROM broadcast_recipients WHERE lower(email) IN (lower($1), lower($2))",
+		"DELETE FROM inbound_emails WHERE lower(sender) IN (lower($1), lower($2))",
+	} {
+		_, err = tx.Exec(query, email, pendingEmail)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// HandleAPIGetAccountExport returns a zip archive of everything we store
+// about the user, minus secrets like password hashes and tokens.
+func (api *API) HandleAPIGetAccountExport(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	files, err := api.accountExport(userID)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/zip")
+	w.Header().Set("content-disposition",
+		fmt.Sprintf(`attachment; filename="readfaster-export-%s.zip"`, time.Now().UTC().Format("2006-01-02")))
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(file.contents)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+type exportFile struct {
+	name     string
+	contents interface{}
+}
+
+func (api *API) accountExport(userID string) ([]exportFile, error) {
+	email := ""
+	hasPassword := false
+	totpEnabled := false
+	pendingEmail := sql.NullString{}
+	createdAt := time.Time{}
+	emailVerifiedAt := sql.NullTime{}
+	role := ""
+	disabledAt := sql.NullTime{}
+	timezone := ""
+	err := api.db.QueryRow(`SELECT email, password <> '', totp_enabled, pending_email, created_at, email_verified_at,
+			role, disabled_at, timezone
+		FROM users WHERE id = $1`, userID).
+		Scan(&email, &hasPassword, &totpEnabled, &pendingEmail, &createdAt, &emailVerifiedAt,
+			&role, &disabledAt, &timezone)
+	if err != nil {
+		return nil, err
+	}
+	profile := map[string]interface{}{
+		"user_id":       userID,
+		"email":         email,
+		"pending_email": pendingEmail.String,
+		"created_at":    createdAt,
+		"has_password":  hasPassword,
+		"totp_enabled":  totpEnabled,
+		"role":          role,
+		"disabled":      disabledAt.Valid,
+		"timezone":      timezone,
+	}
+	if emailVerifiedAt.Valid {
+		profile["email_verified_at"] = emailVerifiedAt.Time
+	}
+	if disabledAt.Valid {
+		profile["disabled_at"] = disabledAt.Time
+	}
+
+	launchSubscriber := map[string]interface{}{}
+	subscribedAt := time.Time{}
+	confirmedAt := sql.NullTime{}
+	unsubscribedAt := sql.NullTime{}
+	err = api.db.QueryRow("SELECT subscribed_at, confirmed_at, unsubscribed_at FROM launch_subscribers WHERE email = $1",
+		email).Scan(&subscribedAt, &confirmedAt, &unsubscribedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		launchSubscriber["subscribed_at"] = subscribedAt
+		if confirmedAt.Valid {
+			launchSubscriber["confirmed_at"] = confirmedAt.Time
+		}
+		if unsubscribedAt.Valid {
+			launchSubscriber["unsubscribed_at"] = unsubscribedAt.Time
+		}
+	}
+	profile["launch_subscriber"] = len(launchSubscriber) > 0
+
+	digest, reminders, announcements := true, true, true
+	err = api.db.QueryRow("SELECT digest, reminders, announcements FROM email_preferences WHERE user_id = $1",
+		userID).Scan(&digest, &reminders, &announcements)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	suppression := ""
+	err = api.db.QueryRow("SELECT reason FROM email_suppressions WHERE email = lower($1)", email).Scan(&suppression)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	emailPreferences := map[string]interface{}{
+		emailCategoryDigest:        digest,
+		emailCategoryReminders:     reminders,
+		emailCategoryAnnouncements: announcements,
+		// Set if we stopped emailing the address after a bounce or
+		// complaint.
+		"suppressed_reason": suppression,
+	}
+	if len(launchSubscriber) > 0 {
+		emailPreferences["launch_subscription"] = launchSubscriber
+	}
+
+	reminder := reminderSettings{RemindAt: 20 * 60}
+	err = api.db.QueryRow("SELECT enabled, remind_at, quiet_start, quiet_end FROM reminder_settings WHERE user_id = $1",
+		userID).Scan(&reminder.Enabled, &reminder.RemindAt, &reminder.QuietStart, &reminder.QuietEnd)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	reminderExport := map[string]interface{}{
+		"enabled":     reminder.Enabled,
+		"time":        formatMinuteOfDay(reminder.RemindAt),
+		"quiet_start": formatMinuteOfDay(reminder.QuietStart),
+		"quiet_end":   formatMinuteOfDay(reminder.QuietEnd),
+		"timezone":    timezone,
+	}
+
+	authSessions := []map[string]interface{}{}
+	rows, err := api.db.Query(`SELECT created_at, renewed_at, expires_at, remember FROM auth_sessions
+		WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		createdAt := time.Time{}
+		renewedAt := time.Time{}
+		expiresAt := time.Time{}
+		remember := false
+		err = rows.Scan(&createdAt, &renewedAt, &expiresAt, &remember)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		authSessions = append(authSessions, map[string]interface{}{
+			"created_at": createdAt,
+			"renewed_at": renewedAt,
+			"expires_at": expiresAt,
+			"remember":   remember,
+		})
+	}
+	rows.Close()
+
+	passkeys := []map[string]interface{}{}
+	rows, err = api.db.Query("SELECT name, created_at, last_used_at FROM webauthn_credentials WHERE user_id = $1 ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		name := ""
+		createdAt := time.Time{}
+		lastUsedAt := sql.NullTime{}
+		err = rows.Scan(&name, &createdAt, &lastUsedAt)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		passkey := map[string]interface{}{
+			"name":       name,
+			"created_at": createdAt,
+		}
+		if lastUsedAt.Valid {
+			passkey["last_used_at"] = lastUsedAt.Time
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	rows.Close()
+
+	readingSessions := []ReadingSession{}
+	rows, err = api.db.Query("SELECT timestamp, duration FROM reading_sessions WHERE user_id = $1 ORDER BY timestamp", userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		session := ReadingSession{}
+		err = rows.Scan(&session.Timestamp, &session.Duration)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		readingSessions = append(readingSessions, session)
+	}
+	rows.Close()
+
+	goodreads := map[string]interface{}{"linked": false}
+	goodreadsUserID := ""
+	goodreadsName := ""
+	checkedAt := sql.NullTime{}
+	brokenAt := sql.NullTime{}
+	err = api.db.QueryRow("SELECT goodreads_user_id, name, checked_at, broken_at FROM goodreads_tokens WHERE user_id = $1",
+		userID).Scan(&goodreadsUserID, &goodreadsName, &checkedAt, &brokenAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		goodreads["linked"] = true
+		goodreads["goodreads_user_id"] = goodreadsUserID
+		goodreads["name"] = goodreadsName
+		goodreads["broken"] = brokenAt.Valid
+		if checkedAt.Valid {
+			goodreads["checked_at"] = checkedAt.Time
+		}
+		if brokenAt.Valid {
+			goodreads["broken_at"] = brokenAt.Time
+		}
+	}
+
+	securityEvents, err := api.auditEvents(userID, 10000)
+	if err != nil {
+		return nil, err
+	}
+
+	return []exportFile{
+		{"profile.json", profile},
+		{"auth_sessions.json", authSessions},
+		{"passkeys.json", passkeys},
+		{"reading_sessions.json", readingSessions},
+		{"email_preferences.json", emailPreferences},
+		{"reminders.json", reminderExport},
+		{"goodreads.json", goodreads},
+		{"security_events.json", securityEvents},
+	}, nil
+}
+
+const emailChangeLinkTTL = 24 * time.Hour
+
+func (api *API) HandleAPIPutEmail(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	requestBody := struct {
+		Email string `json:"email"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	newEmail := strings.TrimSpace(requestBody.Email)
+
+	if err := checkmail.ValidateFormat(newEmail); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Is your email address correct? It doesn't look correct.`))
+		return
+	}
+
+	// Every request mails the new address, so limit both the account and
+	// the address it's sending to.
+	if !api.checkRateLimits(w, rateLimitCheck{changeEmailLimit, userID}, rateLimitCheck{changeEmailToLimit, newEmail}) {
+		return
+	}
+
+	taken := false
+	err = api.db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE email = $1)", newEmail).Scan(&taken)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`That email address is already in use.`))
+		return
+	}
+
+	// The current address stays active until the new one is confirmed.
+	_, err = api.db.Exec("UPDATE users SET pending_email = $1 WHERE id = $2", newEmail, userID)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ts := fmt.Sprint(time.Now().Unix())
+	link := api.origin(r) + "/app/email/confirm?" + url.Values{
+		"user":   []string{userID},
+		"email":  []string{newEmail},
+		"ts":     []string{ts},
+		"verify": []string{api.signature("change-email", ts, userID, newEmail)},
+	}.Encode()
+
+	err = api.sendMail(newEmail, emailChangeEmail, ChangeEmailEmail{ConfirmURL: link})
+	if err != nil {
+		log.Println("error sending email", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (api *API) HandleEmailConfirm(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("user")
+	newEmail := r.URL.Query().Get("email")
+	ts := r.URL.Query().Get("ts")
+	verify := r.URL.Query().Get("verify")
+
+	if !api.checkSignature(verify, "change-email", ts, userID, newEmail) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Bad verify parameter.`))
+		return
+	}
+	if !checkSignedTimestamp(ts, emailChangeLinkTTL) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Link expired.`))
+		return
+	}
+
+	oldEmail := ""
+	err := api.db.QueryRow(`UPDATE users SET email = pending_email, pending_email = NULL, email_verified_at = now()
+		FROM (SELECT email FROM users WHERE id = $1) AS old
+		WHERE id = $1 AND pending_email = $2 RETURNING old.email`, userID, newEmail).Scan(&oldEmail)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`This link is no longer valid.`))
+			return
+		}
+		if isUniqueViolation(err) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`That email address is already in use.`))
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`Something went wrong.`))
+		return
+	}
+
+	api.audit(r, userID, auditEmailChanged, oldEmail+" -> "+newEmail)
+
+	err = api.sendMail(oldEmail, emailEmailChanged, EmailChangedEmail{NewEmail: newEmail})
+	if err != nil {
+		log.Println("error sending email", err)
+	}
+
+	w.Header().Set("Refresh", "2; /app")
+	w.Write([]byte(`Email address updated!`))
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccountExport(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	api := &API{db: db}
+	userID := createTestUser(t, db, "reader@example.com")
+	for _, query := range []string{
+		"UPDATE users SET timezone = 'Europe/Paris' WHERE id = $1",
+		"INSERT INTO email_preferences (user_id, digest) VALUES ($1, false)",
+		"INSERT INTO reminder_settings (user_id, enabled, remind_at) VALUES ($1, true, 480)",
+		"INSERT INTO goodreads_tokens (user_id, token, secret, name, broken_at) VALUES ($1, 'token', 'secret', 'Reader', now())",
+		"INSERT INTO auth_sessions (id, user_id, expires_at) VALUES ('session', $1, now() + interval '1 hour')",
+	} {
+		if _, err := db.Exec(query, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := api.accountExport(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := map[string]interface{}{}
+	for _, file := range files {
+		export[file.name] = file.contents
+	}
+	profile := export["profile.json"].(map[string]interface{})
+	if profile["timezone"] != "Europe/Paris" || profile["role"] != "user" || profile["disabled"] != false {
+		t.Errorf("unexpected profile %v", profile)
+	}
+	if prefs := export["email_preferences.json"].(map[string]interface{}); prefs[emailCategoryDigest] != false {
+		t.Errorf("unexpected email preferences %v", prefs)
+	}
+	if reminders := export["reminders.json"].(map[string]interface{}); reminders["enabled"] != true || reminders["time"] != "08:00" {
+		t.Errorf("unexpected reminders %v", reminders)
+	}
+	if goodreads := export["goodreads.json"].(map[string]interface{}); goodreads["name"] != "Reader" || goodreads["broken"] != true {
+		t.Errorf("unexpected goodreads link %v", goodreads)
+	}
+	sessions := export["auth_sessions.json"].([]map[string]interface{})
+	if len(sessions) != 1 || sessions[0]["created_at"] == nil || sessions[0]["renewed_at"] == nil {
+		t.Errorf("unexpected sessions %v", sessions)
+	}
+}
+
+func TestDeleteAccountRemovesEmailRows(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	api := &API{db: db}
+	userID := createTestUser(t, db, "Reader@example.com")
+	createTestUser(t, db, "other@example.com")
+	for _, query := range []string{
+		"INSERT INTO launch_subscribers (email) VALUES ($1)",
+		"INSERT INTO email_suppressions (email, reason) VALUES (lower($1), 'bounced')",
+		"INSERT INTO email_events (recipient, event, occurred_at) VALUES ($1, 'delivered', now())",
+		"INSERT INTO email_outbox (recipient, subject, text_body) VALUES ($1, 'Hello', 'Hello')",
+		"INSERT INTO inbound_emails (token, sender) VALUES ('token-' || $1, $1)",
+	} {
+		for _, email := range []string{"reader@example.com", "other@example.com"} {
+			if _, err := db.Exec(query, email); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err := api.deleteAccount(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"users", "launch_subscribers", "email_suppressions", "email_events", "email_outbox", "inbound_emails"} {
+		if n := countRows(t, db, "SELECT count(*) FROM "+table); n != 1 {
+			t.Errorf("%s: expected only the other user's row to remain, got %d rows", table, n)
+		}
+	}
+}
+
+func TestPutEmailRateLimits(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	api := &API{db: db, authSecret: "secret", baseURL: "https://www.readfaster.app"}
+
+	putEmail := func(userID, email string) int {
+		r := httptest.NewRequest("PUT", "/api/account/email", strings.NewReader(`{"email": "`+email+`"}`))
+		w := httptest.NewRecorder()
+		api.HandleAPIPutEmail(w, r.WithContext(context.WithValue(r.Context(), userIDContextKey, userID)))
+		return w.Code
+	}
+
+	// Different accounts can't flood one address.
+	for i := 0; i <= int(changeEmailToLimit.burst); i++ {
+		userID := createTestUser(t, db, fmt.Sprintf("reader%d@example.com", i))
+		code := putEmail(userID, "target@example.com")
+		if i == int(changeEmailToLimit.burst) && code != http.StatusTooManyRequests {
+			t.Errorf("expected %d for the same address, got %d", http.StatusTooManyRequests, code)
+		}
+	}
+
+	// One account can't mail many addresses.
+	userID := createTestUser(t, db, "sender@example.com")
+	for i := 0; i <= int(changeEmailLimit.burst); i++ {
+		code := putEmail(userID, fmt.Sprintf("new%d@example.com", i))
+		if i == int(changeEmailLimit.burst) && code != http.StatusTooManyRequests {
+			t.Errorf("expected %d for the same account, got %d", http.StatusTooManyRequests, code)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// WithAdmin wraps a handler with authentication checks and only lets
+// admins through.
+func (api *API) WithAdmin(f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return api.WithAuth(func(w http.ResponseWriter, r *http.Request) {
+		userIDVal := r.Context().Value(userIDContextKey)
+		if userIDVal == nil {
+			log.Println("missing user ID in context")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		userID := userIDVal.(string)
+
+		role := ""
+		err := api.db.QueryRow("SELECT role FROM users WHERE id = $1", userID).Scan(&role)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if role != "admin" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		f(w, r)
+	})
+}
+
+type AdminUser struct {
+	ID            string `json:"id"`
+	Email         string `json:"email"`
+	Role          string `json:"role"`
+	CreatedAt     int64  `json:"created_at"`
+	EmailVerified bool   `json:"email_verified"`
+	Disabled      bool   `json:"disabled"`
+	Sessions      int    `json:"sessions"`
+}
+
+func (api *API) HandleAPIAdminGetUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	rows, err := api.db.Query(`SELECT u.id, u.email, u.role, extract(epoch from u.created_at)::BIGINT,
+			u.email_verified_at IS NOT NULL, u.disabled_at IS NOT NULL,
+			(SELECT count(*) FROM auth_sessions s WHERE s.user_id = u.id AND s.expires_at > now())
+		FROM users u
+		WHERE $1 = '' OR u.email ILIKE '%' || $1 || '%' OR u.id = $1
+		ORDER BY u.created_at DESC LIMIT $2 OFFSET $3`, query, limit, offset)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []AdminUser{}
+	for rows.Next() {
+		user := AdminUser{}
+		err = rows.Scan(&user.ID, &user.Email, &user.Role, &user.CreatedAt,
+			&user.EmailVerified, &user.Disabled, &user.Sessions)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		users = append(users, user)
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+func (api *API) HandleAPIAdminGetStats(w http.ResponseWriter, r *http.Request) {
+	usersTotal, usersVerified, usersDisabled, subscribers := 0, 0, 0, 0
+	err := api.db.QueryRow(`SELECT count(*), count(email_verified_at), count(disabled_at),
+		(SELECT count(*) FROM launch_subscribers WHERE confirmed_at IS NOT NULL AND unsubscribed_at IS NULL)
+		FROM users`).
+		Scan(&usersTotal, &usersVerified, &usersDisabled, &subscribers)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := api.db.Query(`SELECT to_char(date_trunc('day', created_at), 'YYYY-MM-DD'), count(*)
+		FROM users WHERE created_at > now() - interval '30 day'
+		GROUP BY 1 ORDER BY 1`)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	signups := []map[string]interface{}{}
+	for rows.Next() {
+		day := ""
+		count := 0
+		err = rows.Scan(&day, &count)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		signups = append(signups, map[string]interface{}{
+			"date":  day,
+			"count": count,
+		})
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users":              usersTotal,
+		"users_verified":     usersVerified,
+		"users_disabled":     usersDisabled,
+		"launch_subscribers": subscribers,
+		"signups_by_day":     signups,
+	})
+}
+
+type LaunchSubscriber struct {
+	Email          string `json:"email"`
+	Source         string `json:"source"`
+	SubscribedAt   int64  `json:"subscribed_at"`
+	ConfirmedAt    *int64 `json:"confirmed_at"`
+	UnsubscribedAt *int64 `json:"unsubscribed_at"`
+}
+
+// HandleAPIAdminGetLaunchSubscribers lists launch subscribers. By default
+// only confirmed, still subscribed ones are returned; ?all=true returns
+// everyone.
+func (api *API) HandleAPIAdminGetLaunchSubscribers(w http.ResponseWriter, r *http.Request) {
+	all := r.URL.Query().Get("all") == "true"
+	rows, err := api.db.Query(`SELECT email, source, extract(epoch from subscribed_at)::BIGINT,
+			extract(epoch from confirmed_at)::BIGINT, extract(epoch from unsubscribed_at)::BIGINT
+		FROM launch_subscribers
+		WHERE $1 OR (confirmed_at IS NOT NULL AND unsubscribed_at IS NULL)
+		ORDER BY email`, all)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	subscribers := []LaunchSubscriber{}
+	for rows.Next() {
+		s := LaunchSubscriber{}
+		err = rows.Scan(&s.Email, &s.Source, &s.SubscribedAt, &s.ConfirmedAt, &s.UnsubscribedAt)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		subscribers = append(subscribers, s)
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(subscribers)
+}
+
+func (api *API) HandleAPIAdminPostDisableUser(w http.ResponseWriter, r *http.Request) {
+	api.setUserDisabled(w, r, true)
+}
+
+func (api *API) HandleAPIAdminPostEnableUser(w http.ResponseWriter, r *http.Request) {
+	api.setUserDisabled(w, r, false)
+}
+
+func (api *API) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	adminID := r.Context().Value(userIDContextKey).(string)
+	userID := mux.Vars(r)["user_id"]
+
+	if userID == adminID {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`You can't disable your own account.`))
+		return
+	}
+
+	tx, err := api.db.Begin()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	result, err := tx.Exec(`UPDATE users SET disabled_at = CASE WHEN $2 THEN COALESCE(disabled_at, now()) END
+		WHERE id = $1`, userID, disabled)
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		tx.Rollback()
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if disabled {
+		_, err = tx.Exec("DELETE FROM auth_sessions WHERE user_id = $1", userID)
+		if err != nil {
+			tx.Rollback()
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The user sees their own audit events, so which admin acted is only
+	// logged.
+	if disabled {
+		log.Printf("Admin %s disabled user %s", adminID, userID)
+		api.audit(r, userID, auditAccountDisabled, "by an administrator")
+	} else {
+		log.Printf("Admin %s enabled user %s", adminID, userID)
+		api.audit(r, userID, auditAccountEnabled, "by an administrator")
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (api *API) HandleAPIAdminDeleteUserSessions(w http.ResponseWriter, r *http.Request) {
+	adminID := r.Context().Value(userIDContextKey).(string)
+	userID := mux.Vars(r)["user_id"]
+
+	result, err := api.db.Exec("DELETE FROM auth_sessions WHERE user_id = $1", userID)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Admin %s revoked %d sessions of user %s", adminID, n, userID)
+	api.audit(r, userID, auditSessionsRevoked, "by an administrator")
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"revoked": n,
+	})
+}
+
+// promoteAdmins gives the admin role to the users with the given emails.
+func promoteAdmins(db *sql.DB, emails []string) error {
+	for _, email := range emails {
+		result, err := db.Exec("UPDATE users SET role = 'admin' WHERE email = $1", email)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			log.Printf("Admin %s doesn't have an account yet.", email)
+		}
+	}
+	return nil
+}
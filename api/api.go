@@ -5,15 +5,11 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
-	"net/url"
 	"strings"
 	"time"
 
-	"github.com/badoux/checkmail"
-	"github.com/gomodule/oauth1/oauth"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
-	"github.com/mailgun/mailgun-go/v4"
 )
 
 type Options struct {
@@ -24,16 +20,76 @@ type Options struct {
 	AuthSecret      string
 	GoodreadsKey    string
 	GoodreadsSecret string
-	DevMode         bool
+	// GoodreadsURL is the Goodreads base URL. It defaults to
+	// https://www.goodreads.com.
+	GoodreadsURL string
+	BaseURL      string
+	AdminEmails  []string
+	DevMode      bool
+
+	// BreachedPasswordsDir holds a breached password list split into
+	// SHA-1 prefix range files. Empty disables the check.
+	BreachedPasswordsDir string
+
+	// Mailer is "mailgun", "smtp", "file" or "log". It defaults to "log" in
+	// dev mode and "mailgun" otherwise.
+	Mailer        string
+	MailgunDomain string
+	SMTPAddr      string
+	SMTPUsername  string
+	SMTPPassword  string
+	MailDir       string
+	MailFrom      string
+	MailReplyTo   string
+	// MailgunWebhookKey is the signing key for Mailgun event webhooks. Empty
+	// rejects all webhooks.
+	MailgunWebhookKey string
+
+	// Verifier selects the bot check: "recaptcha", "turnstile", "hcaptcha"
+	// or "pow". Dev mode always uses "none".
+	Verifier         string
+	VerifierSecret   string
+	VerifierMinScore float64
+	PoWDifficulty    int
+
+	// SessionTTL is how long an unused session stays valid. Sessions are
+	// extended on use up to SessionMaxLifetime after login.
+	SessionTTL         time.Duration
+	RememberSessionTTL time.Duration
+	SessionMaxLifetime time.Duration
+
+	// UnverifiedAccountTTL is how long accounts with unverified email
+	// addresses are kept. Zero keeps them forever.
+	UnverifiedAccountTTL time.Duration
+
+	// TrustedProxies is the number of reverse proxies in front of the app
+	// that append to X-Forwarded-For. Zero ignores the header.
+	TrustedProxies int
 }
 
 type API struct {
-	db              *sql.DB
-	recaptchaSecret string
-	mg              mailgun.Mailgun
-	authSecret      string
-	goodreads       *oauth.Client
-	devMode         bool
+	db          *sql.DB
+	verifier    Verifier
+	mailer      Mailer
+	mailFrom    string
+	mailReplyTo string
+	authSecret  string
+	goodreads   GoodreadsClient
+	baseURL     string
+	devMode     bool
+
+	breachedPasswordsDir string
+	sessionIdleTTL       time.Duration
+	rememberSessionTTL   time.Duration
+	sessionMaxLifetime   time.Duration
+	unverifiedAccountTTL time.Duration
+	trustedProxies       int
+
+	mailgunWebhookKey string
+	goodreadsCache    *goodreadsCache
+
+	outboxWake chan struct{}
+	notifiers  []Notifier
 }
 
 func Run(opts *Options) error {
@@ -48,50 +104,158 @@ func Run(opts *Options) error {
 		return err
 	}
 
+	err = promoteAdmins(db, opts.AdminEmails)
+	if err != nil {
+		return err
+	}
+
+	verifierKind := opts.Verifier
+	if opts.DevMode {
+		verifierKind = "none"
+	}
+	verifierSecret := opts.VerifierSecret
+	if verifierSecret == "" {
+		verifierSecret = opts.RecaptchaSecret
+	}
+	if verifierKind == "pow" {
+		verifierSecret = opts.AuthSecret
+	}
+	verifier, err := NewVerifier(verifierKind, verifierSecret, opts.VerifierMinScore, opts.PoWDifficulty)
+	if err != nil {
+		return err
+	}
+
+	mailerKind := opts.Mailer
+	if mailerKind == "" {
+		mailerKind = "mailgun"
+		if opts.DevMode {
+			mailerKind = "log"
+		}
+	}
+	mailer, err := NewMailer(MailerOptions{
+		Kind:          mailerKind,
+		MailgunDomain: opts.MailgunDomain,
+		MailgunKey:    opts.MailgunKey,
+		SMTPAddr:      opts.SMTPAddr,
+		SMTPUsername:  opts.SMTPUsername,
+		SMTPPassword:  opts.SMTPPassword,
+		Dir:           opts.MailDir,
+	})
+	if err != nil {
+		return err
+	}
+
 	api := &API{
-		db:              db,
-		recaptchaSecret: opts.RecaptchaSecret,
-		mg:              mailgun.NewMailgun("mg.readfaster.app", opts.MailgunKey),
-		authSecret:      opts.AuthSecret,
-		goodreads: &oauth.Client{
-			TemporaryCredentialRequestURI: "https://www.goodreads.com/oauth/request_token",
-			ResourceOwnerAuthorizationURI: "https://www.goodreads.com/oauth/authorize",
-			TokenRequestURI:               "https://www.goodreads.com/oauth/access_token",
-			Credentials: oauth.Credentials{
-				Token:  opts.GoodreadsKey,
-				Secret: opts.GoodreadsSecret,
-			},
-		},
-		devMode: opts.DevMode,
+		db:          db,
+		verifier:    verifier,
+		mailer:      mailer,
+		mailFrom:    opts.MailFrom,
+		mailReplyTo: opts.MailReplyTo,
+		authSecret:  opts.AuthSecret,
+		goodreads: newScheduledGoodreadsClient(
+			NewGoodreadsClient(opts.GoodreadsURL, opts.GoodreadsKey, opts.GoodreadsSecret),
+			newGoodreadsScheduler(goodreadsRequestInterval, goodreadsMaxWait, goodreadsMaxConcurrent)),
+		goodreadsCache: newGoodreadsCache(goodreadsCacheTTL),
+		baseURL:        strings.TrimSuffix(opts.BaseURL, "/"),
+		devMode:        opts.DevMode,
+
+		breachedPasswordsDir: opts.BreachedPasswordsDir,
+		sessionIdleTTL:       opts.SessionTTL,
+		rememberSessionTTL:   opts.RememberSessionTTL,
+		sessionMaxLifetime:   opts.SessionMaxLifetime,
+		unverifiedAccountTTL: opts.UnverifiedAccountTTL,
+		trustedProxies:       opts.TrustedProxies,
+
+		mailgunWebhookKey: opts.MailgunWebhookKey,
+
+		outboxWake: make(chan struct{}, 1),
+	}
+
+	api.every("sweep-rate-limits", time.Hour, api.sweepRateLimits)
+	api.every("sweep-expired-sessions", time.Hour, api.sweepExpiredSessions)
+	api.every("sweep-audit-events", 24*time.Hour, api.sweepAuditEvents)
+	api.every("sweep-email-outbox", 24*time.Hour, api.sweepEmailOutbox)
+	api.every("sweep-inbound-emails", 24*time.Hour, api.sweepInboundEmails)
+	api.every("sweep-mailgun-webhooks", 24*time.Hour, api.sweepMailgunWebhooks)
+	api.every("send-broadcasts", broadcastInterval, api.sendBroadcasts)
+	api.every("send-weekly-digests", time.Hour, api.sendWeeklyDigests)
+	api.notifiers = []Notifier{&emailNotifier{api: api}}
+	api.every("send-reminders", reminderInterval, api.sendReminders)
+	api.runOutboxWorker()
+	if api.unverifiedAccountTTL > 0 {
+		api.every("purge-unverified-accounts", time.Hour, api.purgeUnverifiedAccounts)
 	}
 
 	r := mux.NewRouter()
 
 	// API
+	r.Methods("GET").Path("/api/verify/challenge").HandlerFunc(api.HandleAPIGetVerifyChallenge)
 	r.Methods("POST").Path("/api/register").HandlerFunc(api.HandleAPIRegister)
 	r.Methods("POST").Path("/api/login").HandlerFunc(api.HandleAPILogin)
-	r.Methods("GET").Path("/api/user").HandlerFunc(api.WithAuth(api.HandleAPIGetUser))
-	r.Methods("PUT").Path("/api/password").HandlerFunc(api.WithAuth((api.HandleAPIPutPassword)))
-	r.Methods("GET").Path("/api/reading/sessions").HandlerFunc(api.WithAuth(api.HandleAPIGetReadingSessions))
-	r.Methods("POST").Path("/api/reading/sessions").HandlerFunc(api.WithAuth(api.HandleAPIPostReadingSessions))
-	r.Methods("DELETE").Path("/api/reading/sessions/{reading_session_timestamp}").HandlerFunc(api.WithAuth(api.HandleAPIDeleteReadingSessions))
-	r.Methods("GET").Path("/api/goodreads/currently_reading").HandlerFunc(api.WithAuth(api.WithGoodreadsCredentials(api.WithGoodreadsUserID(api.HandleAPIGetGoodreadsReviews))))
-	r.Methods("POST").Path("/api/goodreads/books/{goodreads_book_id}/progress").HandlerFunc(api.WithAuth(api.WithGoodreadsCredentials(api.WithGoodreadsUserID(api.HandleAPIPostGoodreadsProgress))))
+	r.Methods("POST").Path("/api/login/totp").HandlerFunc(api.HandleAPILoginTOTP)
+	r.Methods("POST").Path("/api/webauthn/login/begin").HandlerFunc(api.HandleAPIPostWebAuthnLoginBegin)
+	r.Methods("POST").Path("/api/webauthn/login/finish").HandlerFunc(api.HandleAPIPostWebAuthnLoginFinish)
+	r.Methods("GET").Path("/api/user").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIGetUser)))
+	r.Methods("PUT").Path("/api/password").HandlerFunc(api.WithCSRF(api.WithAuth((api.HandleAPIPutPassword))))
+	r.Methods("POST").Path("/api/totp/enroll").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIPostTOTPEnroll)))
+	r.Methods("POST").Path("/api/totp/confirm").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIPostTOTPConfirm)))
+	r.Methods("DELETE").Path("/api/totp").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIDeleteTOTP)))
+	r.Methods("POST").Path("/api/webauthn/register/begin").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIPostWebAuthnRegisterBegin)))
+	r.Methods("POST").Path("/api/webauthn/register/finish").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIPostWebAuthnRegisterFinish)))
+	r.Methods("GET").Path("/api/webauthn/credentials").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIGetWebAuthnCredentials)))
+	r.Methods("DELETE").Path("/api/webauthn/credentials/{credential_id}").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIDeleteWebAuthnCredential)))
+	r.Methods("GET").Path("/api/admin/users").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminGetUsers)))
+	r.Methods("GET").Path("/api/admin/stats").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminGetStats)))
+	r.Methods("GET").Path("/api/admin/launch_subscribers").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminGetLaunchSubscribers)))
+	r.Methods("POST").Path("/api/admin/users/{user_id}/disable").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminPostDisableUser)))
+	r.Methods("POST").Path("/api/admin/users/{user_id}/enable").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminPostEnableUser)))
+	r.Methods("DELETE").Path("/api/admin/users/{user_id}/sessions").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminDeleteUserSessions)))
+	r.Methods("GET").Path("/api/admin/email_templates").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminGetEmailTemplates)))
+	r.Methods("GET").Path("/api/admin/email_templates/{name}/preview").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminGetEmailPreview)))
+	r.Methods("GET").Path("/api/admin/broadcasts").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminGetBroadcasts)))
+	r.Methods("POST").Path("/api/admin/broadcasts").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminPostBroadcast)))
+	r.Methods("GET").Path("/api/admin/broadcasts/{broadcast_id}/preview").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminGetBroadcastPreview)))
+	r.Methods("GET").Path("/api/admin/broadcasts/{broadcast_id}/recipients").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminGetBroadcastRecipients)))
+	r.Methods("POST").Path("/api/admin/broadcasts/{broadcast_id}/send").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminPostBroadcastSend)))
+	r.Methods("POST").Path("/api/admin/broadcasts/{broadcast_id}/cancel").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminPostBroadcastCancel)))
+	r.Methods("GET").Path("/api/admin/email_outbox").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminGetEmailOutbox)))
+	r.Methods("POST").Path("/api/admin/email_outbox/{message_id}/retry").HandlerFunc(api.WithCSRF(api.WithAdmin(api.HandleAPIAdminPostRetryEmail)))
+	r.Methods("GET").Path("/api/security/events").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIGetSecurityEvents)))
+	r.Methods("POST").Path("/api/account/delete").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIPostAccountDelete)))
+	r.Methods("GET").Path("/api/account/export").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIGetAccountExport)))
+	r.Methods("PUT").Path("/api/email").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIPutEmail)))
+	r.Methods("GET").Path("/api/reminders").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIGetReminders)))
+	r.Methods("PUT").Path("/api/reminders").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIPutReminders)))
+	r.Methods("PUT").Path("/api/timezone").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIPutTimezone)))
+	r.Methods("GET").Path("/api/email/preferences").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIGetEmailPreferences)))
+	r.Methods("PUT").Path("/api/email/preferences").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIPutEmailPreferences)))
+	r.Methods("POST").Path("/api/webhooks/mailgun").HandlerFunc(api.HandleMailgunWebhook)
+	r.Methods("POST").Path("/api/inbound/mailgun").HandlerFunc(api.HandleMailgunInbound)
+	r.Methods("GET").Path("/api/reading/sessions").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIGetReadingSessions)))
+	r.Methods("POST").Path("/api/reading/sessions").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIPostReadingSessions)))
+	r.Methods("DELETE").Path("/api/reading/sessions/{reading_session_timestamp}").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleAPIDeleteReadingSessions)))
+	r.Methods("GET").Path("/api/goodreads/currently_reading").HandlerFunc(api.WithCSRF(api.WithAuth(api.WithGoodreadsCredentials(api.WithGoodreadsUserID(api.HandleAPIGetGoodreadsReviews)))))
+	r.Methods("POST").Path("/api/goodreads/books/{goodreads_book_id}/progress").HandlerFunc(api.WithCSRF(api.WithAuth(api.WithGoodreadsCredentials(api.WithGoodreadsUserID(api.HandleAPIPostGoodreadsProgress)))))
 
-	r.Methods("GET").Path("/goodreads/auth").HandlerFunc(api.WithAuth(api.HandleGoodreadsAuth))
-	r.Methods("GET").Path("/goodreads/callback").HandlerFunc(api.WithAuth(api.HandleGoodreadsCallback))
+	r.Methods("GET").Path("/goodreads/auth").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleGoodreadsAuth)))
+	r.Methods("GET").Path("/goodreads/callback").HandlerFunc(api.WithCSRF(api.WithAuth(api.HandleGoodreadsCallback)))
 
 	// Static
 	r.HandleFunc("/launch-subscribe", api.HandleLaunchSubscribe)
+	r.Methods("GET", "POST").Path("/launch-subscribe/confirm").HandlerFunc(api.HandleLaunchSubscribeConfirm)
+	r.Methods("GET", "POST").Path("/launch-subscribe/unsubscribe").HandlerFunc(api.HandleLaunchUnsubscribe)
 	r.HandleFunc("/app/auth", api.HandleAuth)
 	r.HandleFunc("/app/logout", api.HandleLogout)
+	r.HandleFunc("/app/email/confirm", api.HandleEmailConfirm)
+	r.Methods("GET", "POST").Path("/app/unsubscribe").HandlerFunc(api.HandleUnsubscribe)
+	r.Methods("GET", "POST").Path("/app/account/delete").HandlerFunc(api.HandleAccountDelete)
 	r.PathPrefix("/").HandlerFunc(api.HandleRoot)
 
 	log.Println("Listening on", opts.Listen)
 
 	withLog := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		fromCloudFront := req.Header.Get(("from-cloudfront")) == "true"
-		ip := getIP(req)
+		ip := api.clientIP(req)
 		if fromCloudFront {
 			ip += " (CloudFront)"
 		}
@@ -110,70 +274,6 @@ func (api *API) HandleRoot(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func (api *API) HandleLaunchSubscribe(w http.ResponseWriter, r *http.Request) {
-	email := r.URL.Query().Get("email")
-	verify := r.URL.Query().Get("verify")
-
-	if !api.devMode {
-		if verify == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(`Missing verify parameter.`))
-			return
-		} else {
-			// verify CAPTCHA
-			resp, err := http.PostForm("https://www.google.com/recaptcha/api/siteverify", url.Values{
-				"secret":   []string{api.recaptchaSecret},
-				"response": []string{verify},
-			})
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(`Something went wrong!`))
-				return
-			}
-			recaptchaAPIResponse := struct {
-				Success bool    `json:"success"`
-				Score   float64 `json:"score"`
-			}{}
-
-			defer resp.Body.Close()
-			err = json.NewDecoder(resp.Body).Decode(&recaptchaAPIResponse)
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(`Something went wrong!`))
-				return
-			}
-			log.Println("recaptcha response:", recaptchaAPIResponse)
-			if !recaptchaAPIResponse.Success {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(`Bad verify parameter.`))
-				return
-			}
-			if recaptchaAPIResponse.Score < 0.5 {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(`Sorry, you seem like a bot. Please try again.`))
-				return
-			}
-		}
-	}
-
-	if err := checkmail.ValidateFormat(email); err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`Is your email address correct? It doesn't look correct.`))
-		return
-	}
-	_, err := api.db.Exec("INSERT INTO launch_subscribers (email) VALUES ($1) ON CONFLICT DO NOTHING", email)
-	if err == nil {
-		http.Redirect(w, r, "/subscribed.html", http.StatusSeeOther)
-	} else {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`Something went wrong!`))
-	}
-}
-
 func (api *API) HandleAPIGetUser(w http.ResponseWriter, r *http.Request) {
 	userIDVal := r.Context().Value(userIDContextKey)
 	if userIDVal == nil {
@@ -184,7 +284,13 @@ func (api *API) HandleAPIGetUser(w http.ResponseWriter, r *http.Request) {
 	userID := userIDVal.(string)
 
 	email := ""
-	err := api.db.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&email)
+	totpEnabled := false
+	pendingEmail := sql.NullString{}
+	emailVerified := false
+	role := ""
+	timezone := ""
+	err := api.db.QueryRow("SELECT email, totp_enabled, pending_email, email_verified_at IS NOT NULL, role, timezone FROM users WHERE id = $1", userID).
+		Scan(&email, &totpEnabled, &pendingEmail, &emailVerified, &role, &timezone)
 	if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -192,8 +298,10 @@ func (api *API) HandleAPIGetUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	hasGoodreads := false
-	tmp := ""
-	err = api.db.QueryRow("SELECT user_id FROM goodreads_tokens WHERE user_id = $1", userID).Scan(&tmp)
+	goodreadsName := ""
+	goodreadsBroken := false
+	err = api.db.QueryRow("SELECT name, broken_at IS NOT NULL FROM goodreads_tokens WHERE user_id = $1", userID).
+		Scan(&goodreadsName, &goodreadsBroken)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			hasGoodreads = false
@@ -208,8 +316,15 @@ func (api *API) HandleAPIGetUser(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Add("content-type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"user_id":       userID,
-		"email":         email,
-		"has_goodreads": hasGoodreads,
+		"user_id":          userID,
+		"email":            email,
+		"email_verified":   emailVerified,
+		"has_goodreads":    hasGoodreads,
+		"goodreads_name":   goodreadsName,
+		"goodreads_broken": goodreadsBroken,
+		"totp_enabled":     totpEnabled,
+		"pending_email":    pendingEmail.String,
+		"role":             role,
+		"timezone":         timezone,
 	})
 }
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Audit event types.
+const (
+	auditLogin                = "login"
+	auditLoginFailed          = "login_failed"
+	auditLogout               = "logout"
+	auditPasswordChanged      = "password_changed"
+	auditEmailChanged         = "email_changed"
+	auditGoodreadsConnected   = "goodreads_connected"
+	auditGoodreadsBroken      = "goodreads_broken"
+	auditTOTPEnabled          = "totp_enabled"
+	auditTOTPDisabled         = "totp_disabled"
+	auditPasskeyAdded         = "passkey_added"
+	auditPasskeyRemoved       = "passkey_removed"
+	auditAccountDeleteRequest = "account_delete_requested"
+	auditAccountDisabled      = "account_disabled"
+	auditAccountEnabled       = "account_enabled"
+	auditSessionsRevoked      = "sessions_revoked"
+)
+
+const auditRetention = 365 * 24 * time.Hour
+
+// audit records a security event for userID. Failures are only logged so
+// they never break the request being audited.
+func (api *API) audit(r *http.Request, userID, event, detail string) {
+	_, err := api.db.Exec(`INSERT INTO audit_events (user_id, event, detail, ip, user_agent)
+		VALUES ($1, $2, $3, $4, $5)`, userID, event, detail, api.clientIP(r), r.UserAgent())
+	if err != nil {
+		log.Println("error recording audit event", event, err)
+	}
+}
+
+type AuditEvent struct {
+	Event     string `json:"event"`
+	Detail    string `json:"detail"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func (api *API) auditEvents(userID string, limit int) ([]AuditEvent, error) {
+	rows, err := api.db.Query(`SELECT event, detail, ip, user_agent, extract(epoch from created_at)::BIGINT
+		FROM audit_events WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		event := AuditEvent{}
+		err = rows.Scan(&event.Event, &event.Detail, &event.IP, &event.UserAgent, &event.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (api *API) HandleAPIGetSecurityEvents(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	events, err := api.auditEvents(userID, 50)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+func (api *API) sweepAuditEvents() error {
+	_, err := api.db.Exec("DELETE FROM audit_events WHERE created_at < now() - $1::interval", fmtInterval(auditRetention))
+	return err
+}
@@ -7,6 +7,7 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -21,6 +22,22 @@ var (
 	userIDContextKey = "rfa_user_id"
 )
 
+const sessionRenewInterval = time.Hour
+
+var errAccountDisabled = errors.New("account disabled")
+
+// writeSessionError writes the response for a createAuthSession error.
+func writeSessionError(w http.ResponseWriter, err error) {
+	if err == errAccountDisabled {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`This account has been disabled.`))
+		return
+	}
+	log.Println(err)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(`Something went wrong.`))
+}
+
 func (api *API) HandleAPIRegister(w http.ResponseWriter, r *http.Request) {
 	requestBody := struct {
 		Email  string `json:"email"`
@@ -34,48 +51,12 @@ func (api *API) HandleAPIRegister(w http.ResponseWriter, r *http.Request) {
 	email := requestBody.Email
 	verify := requestBody.Verify
 
-	if !api.devMode {
-		if verify == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(`Missing verify parameter.`))
-			return
-		} else {
-			// verify CAPTCHA
-			resp, err := http.PostForm("https://www.google.com/recaptcha/api/siteverify", url.Values{
-				"secret":   []string{api.recaptchaSecret},
-				"response": []string{verify},
-			})
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(`Something went wrong!`))
-				return
-			}
-			recaptchaAPIResponse := struct {
-				Success bool    `json:"success"`
-				Score   float64 `json:"score"`
-			}{}
+	if !api.checkRateLimits(w, rateLimitCheck{registerIPLimit, api.clientIP(r)}, rateLimitCheck{registerEmailLimit, email}) {
+		return
+	}
 
-			defer resp.Body.Close()
-			err = json.NewDecoder(resp.Body).Decode(&recaptchaAPIResponse)
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(`Something went wrong!`))
-				return
-			}
-			log.Println("recaptcha response:", recaptchaAPIResponse)
-			if !recaptchaAPIResponse.Success {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(`Bad verify parameter.`))
-				return
-			}
-			if recaptchaAPIResponse.Score < 0.5 {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(`Sorry, you seem like a bot. Please try again.`))
-				return
-			}
-		}
+	if !api.checkVerify(w, r, verify) {
+		return
 	}
 
 	if err := checkmail.ValidateFormat(email); err != nil {
@@ -85,36 +66,38 @@ func (api *API) HandleAPIRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create a user.
-	_, err = api.db.Exec("INSERT INTO users (id, email) VALUES (encode(gen_random_bytes(5), 'hex'), $1)", email)
+	// Create a user and queue the welcome email together, so neither
+	// happens without the other.
+	tx, err := api.db.Begin()
 	if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(`Something went wrong.`))
 		return
 	}
+	_, err = tx.Exec("INSERT INTO users (id, email) VALUES (encode(gen_random_bytes(5), 'hex'), $1)", email)
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`Something went wrong.`))
+		return
+	}
 
-	ts := fmt.Sprint(time.Now().Unix())
-
-	emailContents := fmt.Sprintf(`Welcome to ReadFaster!
-
-Thanks for registering. Click on the following link to verify your email address and magically log in.
-
-https://www.readfaster.app/app/auth?email=%s&ts=%s&verify=%x
-`, url.QueryEscape(email), ts, sha512.Sum512_256([]byte(api.authSecret+ts+email)))
-
-	htmlEmailContents := fmt.Sprintf(`<p>Welcome to ReadFaster!</p><p>Thanks for registering. Click on the following link to magically log in:
-
-	<a style="font-weight: bold;" href="https://www.readfaster.app/app/auth?email=%s&ts=%s&verify=%x">Log in</a></p>
-`,
-		url.QueryEscape(email), ts, sha512.Sum512_256([]byte(api.authSecret+ts+email)))
-
-	err = api.sendMail(email, "Welcome to ReadFaster!", emailContents, htmlEmailContents)
+	_, err = api.sendMailTx(tx, email, emailWelcome, WelcomeEmail{LoginURL: api.loginLink(r, email)})
 	if err != nil {
-		log.Println("error sending email", err)
+		tx.Rollback()
+		log.Println("error queueing email", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	api.wakeOutbox()
 
 	w.WriteHeader(http.StatusAccepted)
 }
@@ -124,6 +107,7 @@ func (api *API) HandleAPILogin(w http.ResponseWriter, r *http.Request) {
 		Email    string `json:"email"`
 		Password string `json:"password"`
 		Verify   string `json:"verify"`
+		Remember *bool  `json:"remember"`
 	}{}
 	err := json.NewDecoder(r.Body).Decode(&requestBody)
 	if err != nil {
@@ -134,48 +118,12 @@ func (api *API) HandleAPILogin(w http.ResponseWriter, r *http.Request) {
 	password := requestBody.Password
 	verify := requestBody.Verify
 
-	if !api.devMode {
-		if verify == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(`Missing verify parameter.`))
-			return
-		} else {
-			// verify CAPTCHA
-			resp, err := http.PostForm("https://www.google.com/recaptcha/api/siteverify", url.Values{
-				"secret":   []string{api.recaptchaSecret},
-				"response": []string{verify},
-			})
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(`Something went wrong!`))
-				return
-			}
-			recaptchaAPIResponse := struct {
-				Success bool    `json:"success"`
-				Score   float64 `json:"score"`
-			}{}
+	if !api.checkRateLimits(w, rateLimitCheck{loginIPLimit, api.clientIP(r)}, rateLimitCheck{loginEmailLimit, email}) {
+		return
+	}
 
-			defer resp.Body.Close()
-			err = json.NewDecoder(resp.Body).Decode(&recaptchaAPIResponse)
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(`Something went wrong!`))
-				return
-			}
-			log.Println("recaptcha response:", recaptchaAPIResponse)
-			if !recaptchaAPIResponse.Success {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(`Bad verify parameter.`))
-				return
-			}
-			if recaptchaAPIResponse.Score < 0.5 {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(`Sorry, you seem like a bot. Please try again.`))
-				return
-			}
-		}
+	if !api.checkVerify(w, r, verify) {
+		return
 	}
 
 	if err := checkmail.ValidateFormat(email); err != nil {
@@ -190,9 +138,17 @@ func (api *API) HandleAPILogin(w http.ResponseWriter, r *http.Request) {
 	if password != "" {
 		// Password-based auth
 		userID := ""
-		err = api.db.QueryRow("SELECT id FROM users WHERE email = $1 AND password = (crypt($2, password))", email, password).Scan(&userID)
+		totpEnabled := false
+		emailVerified := false
+		lockedFor := 0.0
+		passwordMatches := false
+		err = api.db.QueryRow(`SELECT id, totp_enabled, email_verified_at IS NOT NULL,
+				COALESCE(extract(epoch from locked_until - now()), 0),
+				CASE WHEN password = '' THEN false ELSE password = crypt($2, password) END
+			FROM users WHERE email = $1`,
+			email, password).Scan(&userID, &totpEnabled, &emailVerified, &lockedFor, &passwordMatches)
 		if err != nil {
-			if err == sql.ErrNoRows || err.Error() == "pq: invalid salt" {
+			if err == sql.ErrNoRows {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
@@ -201,56 +157,71 @@ func (api *API) HandleAPILogin(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		sessionID := ""
-		err = api.db.QueryRow(`INSERT INTO auth_sessions (id, user_id, expires_at)
-							VALUES (encode(gen_random_bytes(16), 'hex'),
-									(SELECT id FROM users WHERE email = $1),
-									now()+interval '7 day') RETURNING id`,
-			email).Scan(&sessionID)
+		if lockedFor > 0 {
+			writeTooManyRequests(w, time.Duration(lockedFor*float64(time.Second)))
+			return
+		}
+
+		if !passwordMatches {
+			err = api.recordLoginFailure(userID)
+			if err != nil {
+				log.Println(err)
+			}
+			api.audit(r, userID, auditLoginFailed, "password")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if !emailVerified {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`Please verify your email address using the link we sent you first.`))
+			return
+		}
+
+		if totpEnabled {
+			// The session is only issued by HandleAPILoginTOTP.
+			err = api.createLoginChallenge(w, userID, rememberOrDefault(requestBody.Remember))
+			if err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`Something went wrong.`))
+				return
+			}
+			w.Header().Add("content-type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"totp_required": true,
+			})
+			return
+		}
+
+		err = api.createAuthSession(w, userID, rememberOrDefault(requestBody.Remember))
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(`Something went wrong.`))
+			writeSessionError(w, err)
 			return
 		}
-		http.SetCookie(w, &http.Cookie{
-			Name:     "rfa",
-			Value:    sessionID,
-			Path:     "/",
-			Expires:  time.Now().Add(7 * 24 * time.Hour),
-			Secure:   !api.devMode,
-			HttpOnly: true,
-		})
+		// Failures are only forgiven once a session is issued, so bad
+		// TOTP codes keep escalating the lockout across password logins.
+		err = api.resetLoginFailures(userID)
+		if err != nil {
+			log.Println(err)
+		}
+		api.audit(r, userID, auditLogin, "password")
 		return
 	}
 
-	userID := ""
-	err = api.db.QueryRow("SELECT id FROM users WHERE email = $1", email).Scan(&userID)
+	exists := false
+	err = api.db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE email = $1)", email).Scan(&exists)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	_ = userID
-
-	ts := fmt.Sprint(time.Now().Unix())
-
-	emailContents := fmt.Sprintf(`Click on the following link to magically log in.
-
-https://www.readfaster.app/app/auth?email=%s&ts=%s&verify=%x
-
-Cheers!`, url.QueryEscape(email), ts, sha512.Sum512_256([]byte(api.authSecret+ts+email)))
-
-	htmlEmailContents := fmt.Sprintf(`<p>Click on the following link to magically log in:
-
-	<a style="font-weight: bold;" href="https://www.readfaster.app/app/auth?email=%s&ts=%s&verify=%x">Log in</a></p>`,
-		url.QueryEscape(email), ts, sha512.Sum512_256([]byte(api.authSecret+ts+email)))
+	if !exists {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 
-	err = api.sendMail(email, "ReadFaster Login Link", emailContents, htmlEmailContents)
+	err = api.sendMail(email, emailLoginLink, LoginLinkEmail{LoginURL: api.loginLink(r, email)})
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -259,10 +230,25 @@ Cheers!`, url.QueryEscape(email), ts, sha512.Sum512_256([]byte(api.authSecret+ts
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// loginLinkTTL is how long magic links work.
+const loginLinkTTL = 15 * time.Minute
+
+// loginLink returns a signed magic link that logs email in.
+func (api *API) loginLink(r *http.Request, email string) string {
+	ts := fmt.Sprint(time.Now().Unix())
+	values := url.Values{
+		"email":  []string{email},
+		"ts":     []string{ts},
+		"verify": []string{fmt.Sprintf("%x", sha512.Sum512_256([]byte(api.authSecret+ts+email)))},
+	}
+	return api.origin(r) + "/app/auth?" + values.Encode()
+}
+
 func (api *API) HandleAuth(w http.ResponseWriter, r *http.Request) {
 	email := r.URL.Query().Get("email")
 	ts := r.URL.Query().Get("ts")
 	verify := r.URL.Query().Get("verify")
+	remember := r.URL.Query().Get("remember") != "false"
 
 	log.Println("verify", email, ts, verify)
 
@@ -287,32 +273,47 @@ func (api *API) HandleAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if time.Unix(unixTs, 0).Before(time.Now().Add(-15 * time.Minute)) {
+	if time.Unix(unixTs, 0).Before(time.Now().Add(-loginLinkTTL)) {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(`Link expired.`))
 		return
 	}
 
-	sessionID := ""
-	err = api.db.QueryRow(`INSERT INTO auth_sessions (id, user_id, expires_at)
-							VALUES (encode(gen_random_bytes(16), 'hex'),
-									(SELECT id FROM users WHERE email = $1),
-									now()+interval '7 day') RETURNING id`,
-		email).Scan(&sessionID)
+	userID := ""
+	totpEnabled := false
+	err = api.db.QueryRow(`UPDATE users SET email_verified_at = COALESCE(email_verified_at, now())
+		WHERE email = $1 RETURNING id, totp_enabled`, email).Scan(&userID, &totpEnabled)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`Unknown account.`))
+			return
+		}
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(`Something went wrong.`))
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     "rfa",
-		Value:    sessionID,
-		Path:     "/",
-		Expires:  time.Now().Add(7 * 24 * time.Hour),
-		Secure:   !api.devMode,
-		HttpOnly: true,
-	})
+
+	if totpEnabled {
+		err = api.createLoginChallenge(w, userID, remember)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`Something went wrong.`))
+			return
+		}
+		w.Header().Set("Refresh", "2; /app/login/totp")
+		w.Write([]byte(`Verified! Enter your authentication code to finish logging in.`))
+		return
+	}
+
+	err = api.createAuthSession(w, userID, remember)
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	api.audit(r, userID, auditLogin, "magic_link")
 
 	w.Header().Set("Refresh", "2; /app")
 	w.Write([]byte(`Verified!`))
@@ -326,8 +327,11 @@ func (api *API) HandleLogout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = api.db.Exec("DELETE FROM auth_sessions WHERE id = $1", cookie.Value)
-	if err != nil {
+	userID := ""
+	err = api.db.QueryRow("DELETE FROM auth_sessions WHERE id = $1 RETURNING user_id", cookie.Value).Scan(&userID)
+	if err == nil {
+		api.audit(r, userID, auditLogout, "")
+	} else if err != sql.ErrNoRows {
 		log.Println(err)
 	}
 
@@ -339,6 +343,7 @@ func (api *API) HandleLogout(w http.ResponseWriter, r *http.Request) {
 		Expires:  time.Now(),
 		Secure:   !api.devMode,
 		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
 	})
 	w.Write([]byte(`Logged out.`))
 }
@@ -362,16 +367,91 @@ func (api *API) HandleAPIPutPassword(w http.ResponseWriter, r *http.Request) {
 	}
 	password := requestBody.Password
 
+	email := ""
+	err = api.db.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&email)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	passwordErrors, err := validatePassword(password, email, api.breachedPasswordsDir)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(passwordErrors) > 0 {
+		w.Header().Add("content-type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"errors": passwordErrors,
+		})
+		return
+	}
+
 	_, err = api.db.Exec("UPDATE users SET password = crypt($1, gen_salt('bf')) WHERE id = $2", password, userID)
 	if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	api.audit(r, userID, auditPasswordChanged, "")
 
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// sessionTTL returns how long a session stays valid without being used.
+func (api *API) sessionTTL(remember bool) time.Duration {
+	if remember {
+		return api.rememberSessionTTL
+	}
+	return api.sessionIdleTTL
+}
+
+// rememberOrDefault treats a missing "remember me" choice as remembering
+// the session, which is how logins behaved before it was optional.
+func rememberOrDefault(remember *bool) bool {
+	return remember == nil || *remember
+}
+
+// createAuthSession creates an auth session for userID and sets the session cookie.
+func (api *API) createAuthSession(w http.ResponseWriter, userID string, remember bool) error {
+	sessionID := ""
+	expiresAt := time.Time{}
+	err := api.db.QueryRow(`INSERT INTO auth_sessions (id, user_id, expires_at, remember)
+							SELECT encode(gen_random_bytes(16), 'hex'), id, now()+LEAST($2::interval, $3::interval), $4
+							FROM users WHERE id = $1 AND disabled_at IS NULL
+							RETURNING id, expires_at`,
+		userID, fmtInterval(api.sessionTTL(remember)), fmtInterval(api.sessionMaxLifetime), remember).Scan(&sessionID, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return errAccountDisabled
+		}
+		return err
+	}
+	api.setSessionCookie(w, sessionID, remember, expiresAt)
+	api.setCSRFCookie(w)
+	return nil
+}
+
+// setSessionCookie sets the rfa cookie. Sessions that aren't remembered use
+// a browser session cookie.
+func (api *API) setSessionCookie(w http.ResponseWriter, sessionID string, remember bool, expiresAt time.Time) {
+	cookie := &http.Cookie{
+		Name:     "rfa",
+		Value:    sessionID,
+		Path:     "/",
+		Secure:   !api.devMode,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if remember {
+		cookie.Expires = expiresAt
+	}
+	http.SetCookie(w, cookie)
+}
+
 // WithAuth wraps a handler with authentication checks.
 func (api *API) WithAuth(f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -380,10 +460,16 @@ func (api *API) WithAuth(f func(w http.ResponseWriter, r *http.Request)) func(w
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		sessionID := cookie.Value
 
 		// Get user ID based on this session.
 		userID := ""
-		err = api.db.QueryRow("SELECT user_id FROM auth_sessions WHERE id = $1 AND expires_at > now()", cookie.Value).Scan(&userID)
+		remember := false
+		renew := false
+		err = api.db.QueryRow(`SELECT s.user_id, s.remember, s.renewed_at < now() - $2::interval
+			FROM auth_sessions s JOIN users u ON u.id = s.user_id
+			WHERE s.id = $1 AND s.expires_at > now() AND u.disabled_at IS NULL`,
+			sessionID, fmtInterval(sessionRenewInterval)).Scan(&userID, &remember, &renew)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				w.WriteHeader(http.StatusUnauthorized)
@@ -394,6 +480,21 @@ func (api *API) WithAuth(f func(w http.ResponseWriter, r *http.Request)) func(w
 			return
 		}
 
+		// Slide the expiration forward, at most once per sessionRenewInterval
+		// and never past the session's maximum lifetime.
+		if renew {
+			expiresAt := time.Time{}
+			err = api.db.QueryRow(`UPDATE auth_sessions
+				SET expires_at = LEAST(now() + $2::interval, created_at + $3::interval), renewed_at = now()
+				WHERE id = $1 RETURNING expires_at`,
+				sessionID, fmtInterval(api.sessionTTL(remember)), fmtInterval(api.sessionMaxLifetime)).Scan(&expiresAt)
+			if err != nil {
+				log.Println(err)
+			} else {
+				api.setSessionCookie(w, sessionID, remember, expiresAt)
+			}
+		}
+
 		f(w, r.WithContext(context.WithValue(r.Context(), userIDContextKey, userID)))
 	}
 }
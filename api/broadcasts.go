@@ -0,0 +1,423 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Broadcasts are queued broadcastBatchSize recipients every
+	// broadcastInterval so a large list doesn't flood the outbox or trip
+	// the provider's rate limits.
+	broadcastBatchSize = 100
+	broadcastInterval  = time.Minute
+)
+
+// Broadcast audiences and the recipients each one selects. Addresses that
+// appear in both lists only get one email.
+var broadcastAudiences = map[string]string{
+	"launch_subscribers": `SELECT email, NULL FROM launch_subscribers
+		WHERE confirmed_at IS NOT NULL AND unsubscribed_at IS NULL`,
+	"users": `SELECT email, id FROM users
+		WHERE email_verified_at IS NOT NULL AND disabled_at IS NULL`,
+	"all": `SELECT DISTINCT ON (lower(email)) email, user_id FROM (
+			SELECT email, id AS user_id, 0 AS rank FROM users
+				WHERE email_verified_at IS NOT NULL AND disabled_at IS NULL
+			UNION ALL
+			SELECT email, NULL, 1 FROM launch_subscribers
+				WHERE confirmed_at IS NOT NULL AND unsubscribed_at IS NULL
+		) AS recipients ORDER BY lower(email), rank`,
+}
+
+type Broadcast struct {
+	ID         int64          `json:"id"`
+	Subject    string         `json:"subject"`
+	Markdown   string         `json:"markdown"`
+	Audience   string         `json:"audience"`
+	Status     string         `json:"status"`
+	CreatedAt  int64          `json:"created_at"`
+	StartedAt  *int64         `json:"started_at"`
+	FinishedAt *int64         `json:"finished_at"`
+	Recipients map[string]int `json:"recipients"`
+}
+
+func (api *API) HandleAPIAdminPostBroadcast(w http.ResponseWriter, r *http.Request) {
+	adminID := r.Context().Value(userIDContextKey).(string)
+
+	requestBody := struct {
+		Subject  string `json:"subject"`
+		Markdown string `json:"markdown"`
+		Audience string `json:"audience"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	subject := strings.TrimSpace(requestBody.Subject)
+	if subject == "" || strings.TrimSpace(requestBody.Markdown) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`A broadcast needs a subject and a body.`))
+		return
+	}
+	if _, ok := broadcastAudiences[requestBody.Audience]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Unknown audience.`))
+		return
+	}
+
+	id := int64(0)
+	err = api.db.QueryRow(`INSERT INTO broadcasts (subject, markdown, audience, created_by)
+		VALUES ($1, $2, $3, $4) RETURNING id`, subject, requestBody.Markdown, requestBody.Audience, adminID).Scan(&id)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id": id,
+	})
+}
+
+func (api *API) HandleAPIAdminGetBroadcasts(w http.ResponseWriter, r *http.Request) {
+	rows, err := api.db.Query(`SELECT id, subject, markdown, audience, status,
+			extract(epoch from created_at)::BIGINT, extract(epoch from started_at)::BIGINT,
+			extract(epoch from finished_at)::BIGINT
+		FROM broadcasts ORDER BY id DESC`)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	broadcasts := []*Broadcast{}
+	byID := map[int64]*Broadcast{}
+	for rows.Next() {
+		b := &Broadcast{Recipients: map[string]int{}}
+		err = rows.Scan(&b.ID, &b.Subject, &b.Markdown, &b.Audience, &b.Status,
+			&b.CreatedAt, &b.StartedAt, &b.FinishedAt)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		broadcasts = append(broadcasts, b)
+		byID[b.ID] = b
+	}
+
+	// Queued recipients are counted by how far their email got.
+	rows, err = api.db.Query(`SELECT r.broadcast_id,
+			CASE WHEN r.status = 'queued' THEN COALESCE(o.status, 'sent') ELSE r.status END, count(*)
+		FROM broadcast_recipients r LEFT JOIN email_outbox o ON o.id = r.outbox_id
+		GROUP BY 1, 2`)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		id := int64(0)
+		status := ""
+		n := 0
+		err = rows.Scan(&id, &status, &n)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if b, ok := byID[id]; ok {
+			b.Recipients[status] = n
+		}
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(broadcasts)
+}
+
+func (api *API) broadcastEmail(subject, markdown string) AnnouncementEmail {
+	return AnnouncementEmail{
+		Subject: subject,
+		Text:    markdown,
+		HTML:    template.HTML(renderMarkdown(markdown)),
+	}
+}
+
+// HandleAPIAdminGetBroadcastPreview renders a broadcast as HTML, the way
+// recipients will see it.
+func (api *API) HandleAPIAdminGetBroadcastPreview(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["broadcast_id"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	subject, markdown := "", ""
+	err = api.db.QueryRow("SELECT subject, markdown FROM broadcasts WHERE id = $1", id).Scan(&subject, &markdown)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	msg, err := renderEmail(api.baseURL, api.baseURL+"/app/unsubscribe", "reader@example.com",
+		emailAnnouncement, api.broadcastEmail(subject, markdown))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("content-type", "text/html; charset=utf-8")
+	w.Write([]byte(msg.HTML))
+}
+
+// HandleAPIAdminPostBroadcastSend snapshots the audience into
+// broadcast_recipients and marks it as sending. The batches are queued by
+// the send-broadcasts job, which picks up where it left off after a restart
+// and is the only caller of sendBroadcasts so batches never overlap.
+func (api *API) HandleAPIAdminPostBroadcastSend(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["broadcast_id"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	tx, err := api.db.Begin()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	audience := ""
+	err = tx.QueryRow(`UPDATE broadcasts SET status = 'sending', started_at = now()
+		WHERE id = $1 AND status = 'draft' RETURNING audience`, id).Scan(&audience)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`This broadcast doesn't exist or was already sent.`))
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`INSERT INTO broadcast_recipients (broadcast_id, email, user_id)
+		SELECT $1, email, user_id FROM (`+broadcastAudiences[audience]+`) AS audience (email, user_id)
+		ON CONFLICT DO NOTHING`, id)
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// HandleAPIAdminPostBroadcastCancel stops a broadcast. Emails already in the
+// outbox still go out.
+func (api *API) HandleAPIAdminPostBroadcastCancel(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["broadcast_id"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	result, err := api.db.Exec(`UPDATE broadcasts SET status = 'canceled', finished_at = now()
+		WHERE id = $1 AND status IN ('draft', 'sending')`, id)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type BroadcastRecipient struct {
+	Email     string  `json:"email"`
+	Status    string  `json:"status"`
+	Delivery  *string `json:"delivery"`
+	LastError *string `json:"last_error"`
+	UpdatedAt int64   `json:"updated_at"`
+}
+
+// HandleAPIAdminGetBroadcastRecipients lists recipients with their queue
+// status and, once queued, the outbox delivery status.
+func (api *API) HandleAPIAdminGetBroadcastRecipients(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["broadcast_id"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	rows, err := api.db.Query(`SELECT r.email, r.status, o.status, o.last_error, extract(epoch from r.updated_at)::BIGINT
+		FROM broadcast_recipients r LEFT JOIN email_outbox o ON o.id = r.outbox_id
+		WHERE r.broadcast_id = $1 AND ($2 = '' OR r.status = $2)
+		ORDER BY r.email LIMIT $3 OFFSET $4`, id, status, limit, offset)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	recipients := []BroadcastRecipient{}
+	for rows.Next() {
+		rcpt := BroadcastRecipient{}
+		err = rows.Scan(&rcpt.Email, &rcpt.Status, &rcpt.Delivery, &rcpt.LastError, &rcpt.UpdatedAt)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		recipients = append(recipients, rcpt)
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(recipients)
+}
+
+// sendBroadcasts queues the next batch of every broadcast that's sending.
+func (api *API) sendBroadcasts() error {
+	rows, err := api.db.Query("SELECT id, subject, markdown FROM broadcasts WHERE status = 'sending' ORDER BY id")
+	if err != nil {
+		return err
+	}
+	type broadcast struct {
+		id                int64
+		subject, markdown string
+	}
+	sending := []broadcast{}
+	for rows.Next() {
+		b := broadcast{}
+		err = rows.Scan(&b.id, &b.subject, &b.markdown)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		sending = append(sending, b)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, b := range sending {
+		err = api.sendBroadcastBatch(b.id, api.broadcastEmail(b.subject, b.markdown))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendBroadcastBatch queues emails for the next batch of pending recipients.
+// Recipients are marked in the same transaction that queues their email,
+// so a crash never sends twice or skips anyone.
+func (api *API) sendBroadcastBatch(id int64, email AnnouncementEmail) error {
+	tx, err := api.db.Begin()
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT email FROM broadcast_recipients
+		WHERE broadcast_id = $1 AND status = 'pending'
+		ORDER BY email LIMIT $2 FOR UPDATE SKIP LOCKED`, id, broadcastBatchSize)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	recipients := []string{}
+	for rows.Next() {
+		rcpt := ""
+		err = rows.Scan(&rcpt)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		recipients = append(recipients, rcpt)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, rcpt := range recipients {
+		outboxID, err := api.sendMailTx(tx, rcpt, emailAnnouncement, email)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		status := "queued"
+		if outboxID == 0 {
+			status = "skipped"
+		}
+		_, err = tx.Exec(`UPDATE broadcast_recipients SET status = $3, outbox_id = NULLIF($4::BIGINT, 0), updated_at = now()
+			WHERE broadcast_id = $1 AND email = $2`, id, rcpt, status, outboxID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if len(recipients) < broadcastBatchSize {
+		_, err = tx.Exec(`UPDATE broadcasts SET status = 'sent', finished_at = now()
+			WHERE id = $1 AND status = 'sending'
+				AND NOT EXISTS (SELECT 1 FROM broadcast_recipients WHERE broadcast_id = $1 AND status = 'pending')`, id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	if len(recipients) > 0 {
+		log.Printf("Queued %d emails for broadcast %d.", len(recipients), id)
+		api.wakeOutbox()
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var (
+	errCBORUnsupported = errors.New("cbor: unsupported item")
+	errCBORTooDeep     = errors.New("cbor: nested too deeply")
+	errCBORTruncated   = errors.New("cbor: unexpected end of data")
+)
+
+// cborMaxDepth bounds nesting so hostile input can't exhaust the stack.
+// COSE keys and attestation objects only nest a few levels.
+const cborMaxDepth = 16
+
+// cborDecode decodes the first CBOR item in data and returns it along with
+// the remaining bytes. Only the subset of CBOR used by WebAuthn is supported:
+// integers, byte and text strings, arrays, maps, tags, booleans and null,
+// all with definite lengths. Integers decode as int64, maps as
+// map[interface{}]interface{}.
+func cborDecode(data []byte) (interface{}, []byte, error) {
+	return cborDecodeItem(data, 0)
+}
+
+func cborDecodeItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errCBORTooDeep
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+		return nil, nil, errCBORUnsupported
+	}
+
+	n := uint64(0)
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info == 24 && len(data) >= 1:
+		n = uint64(data[0])
+		data = data[1:]
+	case info == 25 && len(data) >= 2:
+		n = uint64(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	case info == 26 && len(data) >= 4:
+		n = uint64(binary.BigEndian.Uint32(data))
+		data = data[4:]
+	case info == 27 && len(data) >= 8:
+		n = binary.BigEndian.Uint64(data)
+		data = data[8:]
+	default:
+		return nil, nil, errCBORUnsupported
+	}
+
+	switch major {
+	case 0, 1:
+		if n > math.MaxInt64 {
+			return nil, nil, errCBORUnsupported
+		}
+		if major == 0 {
+			return int64(n), data, nil
+		}
+		return -1 - int64(n), data, nil
+	case 2, 3:
+		if uint64(len(data)) < n {
+			return nil, nil, errCBORTruncated
+		}
+		if major == 2 {
+			return append([]byte{}, data[:n]...), data[n:], nil
+		}
+		return string(data[:n]), data[n:], nil
+	case 4:
+		// Every item takes at least a byte, so longer counts can't be valid.
+		if uint64(len(data)) < n {
+			return nil, nil, errCBORTruncated
+		}
+		items := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			item, rest, err := cborDecodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+			data = rest
+		}
+		return items, data, nil
+	case 5:
+		if uint64(len(data))/2 < n {
+			return nil, nil, errCBORTruncated
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			key, rest, err := cborDecodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBORUnsupported
+			}
+			value, rest, err := cborDecodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+			data = rest
+		}
+		return m, data, nil
+	case 6:
+		// Tags are ignored, but still count towards the depth.
+		return cborDecodeItem(data, depth+1)
+	}
+	return nil, nil, errCBORUnsupported
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCBORDecode(t *testing.T) {
+	// {1: 2, 3: -7, -1: h'0102', "a": [true, null]}
+	data := []byte{0xa4, 0x01, 0x02, 0x03, 0x26, 0x20, 0x42, 0x01, 0x02, 0x61, 'a', 0x82, 0xf5, 0xf6, 0xff}
+	item, rest, err := cborDecode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[interface{}]interface{}{
+		int64(1):  int64(2),
+		int64(3):  int64(-7),
+		int64(-1): []byte{1, 2},
+		"a":       []interface{}{true, nil},
+	}
+	if !reflect.DeepEqual(item, expected) {
+		t.Errorf("expected %v, got %v", expected, item)
+	}
+	if !bytes.Equal(rest, []byte{0xff}) {
+		t.Errorf("expected the trailing byte to remain, got %x", rest)
+	}
+}
+
+func TestCBORDecodeRejectsHostileInput(t *testing.T) {
+	cases := map[string][]byte{
+		// Millions of nested one-item arrays used to overflow the stack.
+		"nested arrays": bytes.Repeat([]byte{0x81}, 1<<20),
+		"nested tags":   bytes.Repeat([]byte{0xc1}, 1<<20),
+		"nested maps":   bytes.Repeat([]byte{0xa1, 0x01}, 1<<19),
+		// Counts and lengths larger than the input.
+		"huge array":  {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"huge map":    {0xbb, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"huge string": {0x5a, 0xff, 0xff, 0xff, 0xff, 0x00},
+		"huge int":    {0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	for name, data := range cases {
+		if _, _, err := cborDecode(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// Nesting up to the limit is fine.
+	data := append(bytes.Repeat([]byte{0x81}, cborMaxDepth), 0x01)
+	if _, _, err := cborDecode(data); err != nil {
+		t.Errorf("expected %d levels to decode, got %v", cborMaxDepth, err)
+	}
+}
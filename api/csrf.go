@@ -0,0 +1,78 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+const (
+	csrfCookieName = "rfa_csrf"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// WithCSRF rejects cookie-authenticated mutations that don't come from our
+// own pages. A request passes if its X-CSRF-Token header matches the
+// rfa_csrf cookie, or if its Origin (or Referer) is our own origin. Safe
+// methods aren't checked, but they set the cookie if it's missing.
+func (api *API) WithCSRF(f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			if _, err := r.Cookie(csrfCookieName); err != nil {
+				api.setCSRFCookie(w)
+			}
+			f(w, r)
+			return
+		}
+
+		if token := r.Header.Get(csrfHeaderName); token != "" {
+			cookie, err := r.Cookie(csrfCookieName)
+			if err == nil && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) == 1 {
+				f(w, r)
+				return
+			}
+		} else if requestOrigin(r) == api.origin(r) {
+			f(w, r)
+			return
+		}
+
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`Cross-site request rejected.`))
+	}
+}
+
+// requestOrigin returns the origin a request was sent from according to the
+// Origin header, falling back to the Referer.
+func requestOrigin(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	if origin != "" && origin != "null" {
+		return origin
+	}
+	referer, err := url.Parse(r.Header.Get("Referer"))
+	if err != nil || referer.Host == "" {
+		return ""
+	}
+	return referer.Scheme + "://" + referer.Host
+}
+
+// setCSRFCookie sets a new double-submit token. It's readable from
+// JavaScript so the app can echo it back in the X-CSRF-Token header.
+func (api *API) setCSRFCookie(w http.ResponseWriter) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    hex.EncodeToString(b),
+		Path:     "/",
+		Secure:   !api.devMode,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithCSRF(t *testing.T) {
+	api := &API{baseURL: "https://www.readfaster.app"}
+	handler := api.WithCSRF(func(w http.ResponseWriter, r *http.Request) {})
+
+	cases := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		cookie  string
+		status  int
+	}{
+		{"safe method", "GET", nil, "", http.StatusOK},
+		{"same origin", "POST", map[string]string{"Origin": "https://www.readfaster.app"}, "", http.StatusOK},
+		{"same origin referer", "POST", map[string]string{"Referer": "https://www.readfaster.app/app/"}, "", http.StatusOK},
+		{"cross origin", "POST", map[string]string{"Origin": "https://evil.example"}, "", http.StatusForbidden},
+		{"no origin", "DELETE", nil, "", http.StatusForbidden},
+		{"matching token", "PUT", map[string]string{csrfHeaderName: "abc"}, "abc", http.StatusOK},
+		{"mismatched token", "PUT", map[string]string{csrfHeaderName: "abc", "Origin": "https://www.readfaster.app"}, "xyz", http.StatusForbidden},
+		{"bearer token", "POST", map[string]string{"Authorization": "Bearer session"}, "", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "/api/reading/sessions", nil)
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		if c.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: c.cookie})
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, w.Code)
+		}
+	}
+}
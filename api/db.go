@@ -2,9 +2,24 @@ package api
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"time"
+
+	"github.com/lib/pq"
 )
 
+// fmtInterval formats d as a Postgres interval.
+func fmtInterval(d time.Duration) string {
+	return fmt.Sprintf("%d seconds", int64(d/time.Second))
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint violation.
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
 func setupDatabase(db *sql.DB) error {
 	migrations := []string{
 		/* 000 */ `CREATE TABLE IF NOT EXISTS schema_version (version INT PRIMARY KEY, timestamp TIMESTAMP)`,
@@ -26,6 +41,171 @@ func setupDatabase(db *sql.DB) error {
 					   secret TEXT,
 					   PRIMARY KEY (user_id)
 				   )`,
+		/* 008 */ `ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '',
+				       ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT false,
+				       ADD COLUMN totp_last_counter BIGINT NOT NULL DEFAULT 0;
+				   CREATE TABLE totp_recovery_codes (
+				       user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				       code TEXT NOT NULL,
+				       used_at TIMESTAMP,
+				       PRIMARY KEY (user_id, code)
+				   );
+				   CREATE TABLE login_challenges (
+				       id TEXT PRIMARY KEY,
+				       user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				       attempts INT NOT NULL DEFAULT 0,
+				       expires_at TIMESTAMP NOT NULL
+				   )`,
+		/* 009 */ `CREATE TABLE webauthn_credentials (
+				       id TEXT PRIMARY KEY,
+				       user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				       name TEXT NOT NULL,
+				       public_key BYTEA NOT NULL,
+				       sign_count BIGINT NOT NULL DEFAULT 0,
+				       created_at TIMESTAMP NOT NULL DEFAULT now(),
+				       last_used_at TIMESTAMP
+				   );
+				   CREATE INDEX idx_webauthn_credentials_user_id ON webauthn_credentials (user_id);
+				   CREATE TABLE webauthn_challenges (
+				       id TEXT PRIMARY KEY,
+				       user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+				       kind TEXT NOT NULL,
+				       challenge TEXT NOT NULL,
+				       expires_at TIMESTAMP NOT NULL
+				   )`,
+		/* 010 */ `DELETE FROM auth_sessions WHERE user_id NOT IN (SELECT id FROM users);
+				   ALTER TABLE auth_sessions ADD CONSTRAINT auth_sessions_user_id_fkey
+				       FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE`,
+		/* 011 */ `ALTER TABLE users ADD COLUMN pending_email TEXT`,
+		/* 012 */ `ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP,
+				       ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT now();
+				   -- Anyone who has logged in before must have used a magic link.
+				   UPDATE users SET email_verified_at = now()
+				       WHERE password <> ''
+				       OR id IN (SELECT user_id FROM auth_sessions)
+				       OR id IN (SELECT user_id FROM reading_sessions)
+				       OR id IN (SELECT user_id FROM goodreads_tokens)`,
+		/* 013 */ `CREATE TABLE rate_limits (
+				       key TEXT PRIMARY KEY,
+				       tokens DOUBLE PRECISION NOT NULL,
+				       updated_at TIMESTAMP NOT NULL
+				   );
+				   ALTER TABLE users ADD COLUMN failed_logins INT NOT NULL DEFAULT 0,
+				       ADD COLUMN locked_until TIMESTAMP`,
+		/* 014 */ `ALTER TABLE auth_sessions ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT now(),
+				       ADD COLUMN renewed_at TIMESTAMP NOT NULL DEFAULT now(),
+				       ADD COLUMN remember BOOLEAN NOT NULL DEFAULT true;
+				   CREATE INDEX idx_auth_sessions_expires_at ON auth_sessions (expires_at);
+				   ALTER TABLE login_challenges ADD COLUMN remember BOOLEAN NOT NULL DEFAULT true`,
+		/* 015 */ `CREATE TABLE audit_events (
+				       id BIGSERIAL PRIMARY KEY,
+				       user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+				       event TEXT NOT NULL,
+				       detail TEXT NOT NULL DEFAULT '',
+				       ip TEXT NOT NULL DEFAULT '',
+				       user_agent TEXT NOT NULL DEFAULT '',
+				       created_at TIMESTAMP NOT NULL DEFAULT now()
+				   );
+				   CREATE INDEX idx_audit_events_user_id ON audit_events (user_id, created_at)`,
+		/* 016 */ `ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user',
+				       ADD COLUMN disabled_at TIMESTAMP`,
+		/* 017 */ `CREATE TABLE email_outbox (
+				       id BIGSERIAL PRIMARY KEY,
+				       recipient TEXT NOT NULL,
+				       subject TEXT NOT NULL,
+				       text_body TEXT NOT NULL,
+				       html_body TEXT NOT NULL DEFAULT '',
+				       headers TEXT NOT NULL DEFAULT '{}',
+				       status TEXT NOT NULL DEFAULT 'pending',
+				       attempts INT NOT NULL DEFAULT 0,
+				       last_error TEXT NOT NULL DEFAULT '',
+				       next_attempt_at TIMESTAMP NOT NULL DEFAULT now(),
+				       created_at TIMESTAMP NOT NULL DEFAULT now(),
+				       sent_at TIMESTAMP
+				   );
+				   CREATE INDEX idx_email_outbox_due ON email_outbox (next_attempt_at) WHERE status = 'pending'`,
+		/* 018 */ `CREATE TABLE email_preferences (
+				       user_id TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+				       digest BOOLEAN NOT NULL DEFAULT true,
+				       reminders BOOLEAN NOT NULL DEFAULT true,
+				       announcements BOOLEAN NOT NULL DEFAULT true,
+				       updated_at TIMESTAMP NOT NULL DEFAULT now()
+				   )`,
+		/* 019 */ `CREATE TABLE email_events (
+				       id BIGSERIAL PRIMARY KEY,
+				       recipient TEXT NOT NULL,
+				       event TEXT NOT NULL,
+				       severity TEXT NOT NULL DEFAULT '',
+				       reason TEXT NOT NULL DEFAULT '',
+				       message_id TEXT NOT NULL DEFAULT '',
+				       occurred_at TIMESTAMP NOT NULL,
+				       created_at TIMESTAMP NOT NULL DEFAULT now()
+				   );
+				   CREATE INDEX idx_email_events_recipient ON email_events (lower(recipient), occurred_at);
+				   CREATE TABLE email_suppressions (
+				       email TEXT PRIMARY KEY,
+				       reason TEXT NOT NULL,
+				       created_at TIMESTAMP NOT NULL DEFAULT now()
+				   )`,
+		/* 020 */ `ALTER TABLE launch_subscribers ADD COLUMN subscribed_at TIMESTAMP NOT NULL DEFAULT now(),
+				       ADD COLUMN confirmed_at TIMESTAMP,
+				       ADD COLUMN source TEXT NOT NULL DEFAULT '',
+				       ADD COLUMN unsubscribed_at TIMESTAMP;
+				   -- Earlier subscriptions were never confirmed, so they stay unconfirmed.
+				   UPDATE launch_subscribers SET source = 'legacy'`,
+		/* 021 */ `CREATE TABLE broadcasts (
+				       id BIGSERIAL PRIMARY KEY,
+				       subject TEXT NOT NULL,
+				       markdown TEXT NOT NULL,
+				       audience TEXT NOT NULL,
+				       status TEXT NOT NULL DEFAULT 'draft',
+				       created_by TEXT REFERENCES users(id) ON DELETE SET NULL,
+				       created_at TIMESTAMP NOT NULL DEFAULT now(),
+				       started_at TIMESTAMP,
+				       finished_at TIMESTAMP
+				   );
+				   CREATE TABLE broadcast_recipients (
+				       broadcast_id BIGINT NOT NULL REFERENCES broadcasts(id) ON DELETE CASCADE,
+				       email TEXT NOT NULL,
+				       user_id TEXT REFERENCES users(id) ON DELETE SET NULL,
+				       status TEXT NOT NULL DEFAULT 'pending',
+				       outbox_id BIGINT,
+				       updated_at TIMESTAMP NOT NULL DEFAULT now(),
+				       PRIMARY KEY (broadcast_id, email)
+				   )`,
+		/* 022 */ `ALTER TABLE users ADD COLUMN timezone TEXT NOT NULL DEFAULT 'UTC';
+				   CREATE TABLE digest_sends (
+				       user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				       week_start DATE NOT NULL,
+				       outbox_id BIGINT,
+				       created_at TIMESTAMP NOT NULL DEFAULT now(),
+				       PRIMARY KEY (user_id, week_start)
+				   )`,
+		/* 023 */ `CREATE TABLE reminder_settings (
+				       user_id TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+				       enabled BOOLEAN NOT NULL DEFAULT false,
+				       remind_at INT NOT NULL,
+				       quiet_start INT NOT NULL DEFAULT 0,
+				       quiet_end INT NOT NULL DEFAULT 0,
+				       last_sent_on DATE,
+				       updated_at TIMESTAMP NOT NULL DEFAULT now()
+				   )`,
+		/* 024 */ `CREATE TABLE inbound_emails (
+				       token TEXT PRIMARY KEY,
+				       sender TEXT NOT NULL,
+				       created_at TIMESTAMP NOT NULL DEFAULT now()
+				   )`,
+		/* 025 */ `ALTER TABLE goodreads_tokens ADD COLUMN goodreads_user_id TEXT NOT NULL DEFAULT '',
+				       ADD COLUMN name TEXT NOT NULL DEFAULT '',
+				       ADD COLUMN checked_at TIMESTAMP,
+				       ADD COLUMN broken_at TIMESTAMP`,
+		/* 026 */ `ALTER TABLE email_outbox ADD COLUMN expires_at TIMESTAMP`,
+		/* 027 */ `CREATE TABLE mailgun_webhooks (
+				       token TEXT NOT NULL,
+				       timestamp TEXT NOT NULL,
+				       created_at TIMESTAMP NOT NULL DEFAULT now(),
+				       PRIMARY KEY (token, timestamp)
+				   )`,
 	}
 
 	tx, err := db.Begin()
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+)
+
+// testDB connects to the database in TEST_DATABASE_URL, migrates it and
+// empties every table. Tests that need Postgres are skipped without it.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	connString := os.Getenv("TEST_DATABASE_URL")
+	if connString == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setupDatabase(db)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	tables := ""
+	err = db.QueryRow(`SELECT string_agg(quote_ident(tablename), ', ') FROM pg_tables
+		WHERE schemaname = current_schema() AND tablename <> 'schema_version'`).Scan(&tables)
+	if err == nil {
+		_, err = db.Exec("TRUNCATE " + tables + " CASCADE")
+	}
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	return db
+}
+
+// createTestUser adds a verified user and returns its ID.
+func createTestUser(t *testing.T, db *sql.DB, email string) string {
+	t.Helper()
+	userID := ""
+	err := db.QueryRow(`INSERT INTO users (id, email, email_verified_at)
+		VALUES (encode(gen_random_bytes(5), 'hex'), $1, now()) RETURNING id`, email).Scan(&userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// Digests go out on Monday from digestHour in the user's timezone and
+	// cover the week before.
+	digestWeekday = time.Monday
+	digestHour    = 8
+	// digestStreakDays bounds how far back streaks are counted.
+	digestStreakDays = 365
+)
+
+type digestStats struct {
+	Minutes         int
+	Sessions        int
+	PreviousMinutes int
+	StreakDays      int
+}
+
+// digestWeekStart returns the start of the week before now in loc, and
+// whether a digest for it is due at now.
+func digestWeekStart(now time.Time, loc *time.Location) (time.Time, bool) {
+	local := now.In(loc)
+	daysSinceMonday := (int(local.Weekday()) + 6) % 7
+	thisWeek := time.Date(local.Year(), local.Month(), local.Day()-daysSinceMonday, 0, 0, 0, 0, loc)
+	due := local.Weekday() != digestWeekday || local.Hour() >= digestHour
+	return thisWeek.AddDate(0, 0, -7), due
+}
+
+// computeDigestStats summarizes sessions for the week starting at
+// weekStart, compares it with the week before, and counts the streak of
+// days with reading that ends on the week's last day. Durations are in
+// seconds.
+func computeDigestStats(sessions []ReadingSession, weekStart time.Time) digestStats {
+	loc := weekStart.Location()
+	weekEnd := weekStart.AddDate(0, 0, 7)
+	prevStart := weekStart.AddDate(0, 0, -7)
+
+	stats := digestStats{}
+	seconds, prevSeconds := 0, 0
+	days := map[string]bool{}
+	for _, s := range sessions {
+		t := time.Unix(s.Timestamp, 0).In(loc)
+		switch {
+		case !t.Before(weekStart) && t.Before(weekEnd):
+			seconds += s.Duration
+			stats.Sessions++
+		case !t.Before(prevStart) && t.Before(weekStart):
+			prevSeconds += s.Duration
+		}
+		if t.Before(weekEnd) {
+			days[t.Format("2006-01-02")] = true
+		}
+	}
+	stats.Minutes = (seconds + 30) / 60
+	stats.PreviousMinutes = (prevSeconds + 30) / 60
+
+	day := weekEnd.AddDate(0, 0, -1)
+	for stats.StreakDays < digestStreakDays && days[day.Format("2006-01-02")] {
+		stats.StreakDays++
+		day = day.AddDate(0, 0, -1)
+	}
+	return stats
+}
+
+// sendWeeklyDigests queues digests that are due. It runs hourly, and
+// digest_sends makes sure each user gets one digest per week even with
+// several instances running.
+func (api *API) sendWeeklyDigests() error {
+	rows, err := api.db.Query(`SELECT u.id, u.email, u.timezone FROM users u
+		LEFT JOIN email_preferences p ON p.user_id = u.id
+		WHERE u.email_verified_at IS NOT NULL AND u.disabled_at IS NULL AND COALESCE(p.digest, true)`)
+	if err != nil {
+		return err
+	}
+	type recipient struct {
+		userID, email, timezone string
+	}
+	recipients := []recipient{}
+	for rows.Next() {
+		rcpt := recipient{}
+		err = rows.Scan(&rcpt.userID, &rcpt.email, &rcpt.timezone)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		recipients = append(recipients, rcpt)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	sent := 0
+	for _, rcpt := range recipients {
+		loc, err := time.LoadLocation(rcpt.timezone)
+		if err != nil {
+			loc = time.UTC
+		}
+		weekStart, due := digestWeekStart(now, loc)
+		if !due {
+			continue
+		}
+		ok, err := api.sendDigest(rcpt.userID, rcpt.email, weekStart)
+		if err != nil {
+			return err
+		}
+		if ok {
+			sent++
+		}
+	}
+	if sent > 0 {
+		log.Printf("Queued %d weekly digests.", sent)
+		api.wakeOutbox()
+	}
+	return nil
+}
+
+// sendDigest queues the digest for the week starting at weekStart unless it
+// was already sent or the user didn't read in either week.
+func (api *API) sendDigest(userID, email string, weekStart time.Time) (bool, error) {
+	weekOf := weekStart.Format("2006-01-02")
+	alreadySent := false
+	err := api.db.QueryRow("SELECT EXISTS (SELECT 1 FROM digest_sends WHERE user_id = $1 AND week_start = $2)",
+		userID, weekOf).Scan(&alreadySent)
+	if err != nil || alreadySent {
+		return false, err
+	}
+
+	since := weekStart.AddDate(0, 0, -digestStreakDays)
+	rows, err := api.db.Query("SELECT timestamp, duration FROM reading_sessions WHERE user_id = $1 AND timestamp >= $2 AND timestamp < $3",
+		userID, since.Unix(), weekStart.AddDate(0, 0, 7).Unix())
+	if err != nil {
+		return false, err
+	}
+	sessions := []ReadingSession{}
+	for rows.Next() {
+		s := ReadingSession{}
+		err = rows.Scan(&s.Timestamp, &s.Duration)
+		if err != nil {
+			rows.Close()
+			return false, err
+		}
+		sessions = append(sessions, s)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+
+	stats := computeDigestStats(sessions, weekStart)
+	if stats.Minutes == 0 && stats.PreviousMinutes == 0 {
+		return false, nil
+	}
+
+	tx, err := api.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	result, err := tx.Exec("INSERT INTO digest_sends (user_id, week_start) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		userID, weekOf)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		return false, err
+	}
+	outboxID, err := api.sendMailTx(tx, email, emailDigest, DigestEmail{
+		WeekOf:          weekStart.Format("January 2"),
+		Minutes:         stats.Minutes,
+		Sessions:        stats.Sessions,
+		StreakDays:      stats.StreakDays,
+		PreviousMinutes: stats.PreviousMinutes,
+		AppURL:          api.baseURL + "/app",
+	})
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	_, err = tx.Exec("UPDATE digest_sends SET outbox_id = NULLIF($3::BIGINT, 0) WHERE user_id = $1 AND week_start = $2",
+		userID, weekOf, outboxID)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return outboxID != 0, tx.Commit()
+}
+
+func (api *API) HandleAPIPutTimezone(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	requestBody := struct {
+		Timezone string `json:"timezone"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// LoadLocation treats "" as UTC and also accepts "Local", which would
+	// mean the server's zone.
+	if requestBody.Timezone == "" || requestBody.Timezone == "Local" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Unknown timezone.`))
+		return
+	}
+	if _, err := time.LoadLocation(requestBody.Timezone); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Unknown timezone.`))
+		return
+	}
+
+	_, err = api.db.Exec("UPDATE users SET timezone = $1 WHERE id = $2", requestBody.Timezone, userID)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
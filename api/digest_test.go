@@ -0,0 +1,56 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDigestWeekStart(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	cases := []struct {
+		now       time.Time
+		weekStart string
+		due       bool
+	}{
+		// Monday 7am in New York: not due yet.
+		{time.Date(2020, 3, 16, 11, 0, 0, 0, time.UTC), "2020-03-09", false},
+		// Monday 9am in New York.
+		{time.Date(2020, 3, 16, 13, 0, 0, 0, time.UTC), "2020-03-09", true},
+		// Still Sunday in New York, Monday in UTC.
+		{time.Date(2020, 3, 16, 2, 0, 0, 0, time.UTC), "2020-03-02", true},
+	}
+	for _, c := range cases {
+		weekStart, due := digestWeekStart(c.now, ny)
+		if weekStart.Format("2006-01-02") != c.weekStart || due != c.due {
+			t.Errorf("%v: expected %s %v, got %s %v", c.now, c.weekStart, c.due, weekStart.Format("2006-01-02"), due)
+		}
+	}
+}
+
+func TestComputeDigestStats(t *testing.T) {
+	weekStart := time.Date(2020, 3, 9, 0, 0, 0, 0, time.UTC)
+	at := func(day, hour int) int64 {
+		return time.Date(2020, 3, day, hour, 0, 0, 0, time.UTC).Unix()
+	}
+	sessions := []ReadingSession{
+		{at(5, 20), 600},   // previous week
+		{at(10, 8), 1200},  // Tuesday
+		{at(13, 21), 900},  // Friday
+		{at(14, 9), 300},   // Saturday
+		{at(15, 22), 1500}, // Sunday
+		{at(16, 7), 600},   // this week, not counted
+	}
+	stats := computeDigestStats(sessions, weekStart)
+	expected := digestStats{Minutes: 65, Sessions: 4, PreviousMinutes: 10, StreakDays: 3}
+	if stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+
+	stats = computeDigestStats(sessions[:2], weekStart)
+	if stats.StreakDays != 0 {
+		t.Errorf("expected no streak without reading on Sunday, got %d", stats.StreakDays)
+	}
+}
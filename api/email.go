@@ -2,13 +2,20 @@ package api
 
 import (
 	"bytes"
-	"context"
+	"encoding/json"
+	"fmt"
 	"html/template"
 	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	texttemplate "text/template"
 	"time"
+
+	"github.com/gorilla/mux"
 )
 
-var textTemplate = template.Must(template.New("text").Parse(`Hello!
+var textLayout = texttemplate.Must(texttemplate.New("text").Parse(`Hello!
 
 {{ .Content }}
 
@@ -16,10 +23,14 @@ Cheers,
 --ReadFaster.app
 
 You are receiving this email because you signed up for ReadFaster.app.
-https://www.readfaster.app
+{{ .BaseURL }}
+{{- if .UnsubscribeURL }}
+
+Unsubscribe: {{ .UnsubscribeURL }}
+{{- end }}
 `))
 
-var emailTemplate = template.Must(template.New("email").Parse(`
+var htmlLayout = template.Must(template.New("email").Parse(`
 <!DOCTYPE html>
 <html>
 <head>
@@ -36,9 +47,8 @@ p {
 <body>
 <div style="font-family: 'Inter', -apple-system, BlinkMacSystemFont, Segoe UI, Roboto, Oxygen, Ubuntu, Cantarell, Fira Sans, Droid Sans, Helvetica Neue, sans-serif; font-size: 18px; width: 40rem; margin: 0 auto; max-width: 90%">
 <div style="background-color: black; color: white; text-align: center;">
-<a style="text-decoration: none; color: white;" href="https://www.readfaster.app/"><img alt="ReadFaster" src="https://www.readfaster.app/img/logo-dark.png" style="width: 200px; height: 50px; margin: 50px;"/></a>
+<a style="text-decoration: none; color: white;" href="{{ .BaseURL }}/"><img alt="ReadFaster" src="{{ .BaseURL }}/img/logo-dark.png" style="width: 200px; height: 50px; margin: 50px;"/></a>
 </div>
-
 <div style="margin: 2rem;">
 <p style="margin-bottom: 1rem;">Hello!</p>
 
@@ -52,7 +62,10 @@ p {
 </div>
 
 <div style="background-color: black; color: #888; font-size: 0.75rem; text-align: center; padding: 1rem;">
-You’re receiving this email because you signed up for <a style="color: #888" href="https://www.readfaster.app">ReadFaster.app</a>.
+You’re receiving this email because you signed up for <a style="color: #888" href="{{ .BaseURL }}">ReadFaster.app</a>.
+{{- if .UnsubscribeURL }}
+<a style="color: #888" href="{{ .UnsubscribeURL }}">Unsubscribe</a>
+{{- end }}
 </div>
 </div>
 </body>
@@ -60,45 +73,392 @@ You’re receiving this email because you signed up for <a style="color: #888" h
 </html>
 `))
 
-func (api *API) sendMail(to, subject, content, htmlContent string) error {
-	if htmlContent != "" {
-		buf := &bytes.Buffer{}
-		err := emailTemplate.Execute(buf, map[string]interface{}{
-			"HTMLContent": template.HTML(htmlContent),
+// An emailKind is a registered email template. Each kind is rendered from
+// one data type, and sample holds a value of that type for previews.
+// Transactional emails have no category; others belong to one of the
+// emailCategories users can opt out of.
+type emailKind struct {
+	category string
+	subject  *texttemplate.Template
+	text     *texttemplate.Template
+	html     *template.Template
+	sample   interface{}
+}
+
+var emailKinds = map[string]*emailKind{}
+
+func registerEmail(name, category, subject, text, html string, sample interface{}) {
+	emailKinds[name] = &emailKind{
+		category: category,
+		subject:  texttemplate.Must(texttemplate.New(name + "-subject").Parse(subject)),
+		text:     texttemplate.Must(texttemplate.New(name + "-text").Parse(text)),
+		html:     template.Must(template.New(name + "-html").Parse(html)),
+		sample:   sample,
+	}
+}
+
+// emailLinkTTLs holds how long the links in time-sensitive emails work.
+// These emails are dropped if they can't be delivered in time, and their
+// bodies aren't kept once they're sent.
+var emailLinkTTLs = map[string]time.Duration{
+	emailWelcome:       loginLinkTTL,
+	emailLoginLink:     loginLinkTTL,
+	emailPasswordReset: loginLinkTTL,
+	emailDeleteAccount: accountDeletionLinkTTL,
+	emailChangeEmail:   emailChangeLinkTTL,
+	emailLaunchConfirm: launchConfirmLinkTTL,
+}
+
+const (
+	emailWelcome       = "welcome"
+	emailLoginLink     = "login_link"
+	emailPasswordReset = "password_reset"
+	emailDigest        = "digest"
+	emailDeleteAccount = "delete_account"
+	emailChangeEmail   = "change_email"
+	emailEmailChanged  = "email_changed"
+	emailLaunchConfirm = "launch_confirm"
+	emailAnnouncement  = "announcement"
+	emailReminder      = "reminder"
+	emailReadingLogged = "reading_logged"
+	// emailReadingNotUnderstood replies to inbound mail we couldn't parse.
+	emailReadingNotUnderstood = "reading_not_understood"
+)
+
+type WelcomeEmail struct {
+	LoginURL string
+}
+
+type LoginLinkEmail struct {
+	LoginURL string
+}
+
+type PasswordResetEmail struct {
+	ResetURL string
+}
+
+type DigestEmail struct {
+	WeekOf          string
+	Minutes         int
+	Sessions        int
+	StreakDays      int
+	PreviousMinutes int
+	AppURL          string
+}
+
+type DeleteAccountEmail struct {
+	ConfirmURL string
+}
+
+type ChangeEmailEmail struct {
+	ConfirmURL string
+}
+
+type EmailChangedEmail struct {
+	NewEmail string
+}
+
+// AnnouncementEmail is a broadcast. HTML is rendered from Markdown by
+// renderMarkdown, and Text is the Markdown source.
+type AnnouncementEmail struct {
+	Subject string
+	Text    string
+	HTML    template.HTML
+}
+
+type ReminderEmail struct {
+	StreakDays int
+	AppURL     string
+}
+
+// ReadingLoggedEmail confirms a session logged by email. Title may be empty.
+type ReadingLoggedEmail struct {
+	Minutes int
+	Title   string
+	AppURL  string
+}
+
+type ReadingNotUnderstoodEmail struct{}
+
+type LaunchConfirmEmail struct {
+	ConfirmURL     string
+	UnsubscribeURL string
+}
+
+func init() {
+	registerEmail(emailWelcome, "", "Welcome to ReadFaster!", `Welcome to ReadFaster!
+
+Thanks for registering. Click on the following link to verify your email address and magically log in.
+
+{{ .LoginURL }}
+`, `<p>Welcome to ReadFaster!</p><p>Thanks for registering. Click on the following link to magically log in:
+
+	<a style="font-weight: bold;" href="{{ .LoginURL }}">Log in</a></p>`,
+		WelcomeEmail{LoginURL: "https://www.readfaster.app/app/auth?email=reader%40example.com&ts=0&verify=0"})
+
+	registerEmail(emailLoginLink, "", "ReadFaster Login Link", `Click on the following link to magically log in.
+
+{{ .LoginURL }}
+`, `<p>Click on the following link to magically log in:
+
+	<a style="font-weight: bold;" href="{{ .LoginURL }}">Log in</a></p>`,
+		LoginLinkEmail{LoginURL: "https://www.readfaster.app/app/auth?email=reader%40example.com&ts=0&verify=0"})
+
+	registerEmail(emailPasswordReset, "", "Reset your ReadFaster password", `We received a request to reset your ReadFaster password.
+
+Click on the following link within 15 minutes to log in and choose a new password. If you didn't ask for this, you can ignore this email.
+
+{{ .ResetURL }}
+`, `<p>We received a request to reset your ReadFaster password.</p>
+<p>Click on the following link within 15 minutes to log in and choose a new password. If you didn't ask for this, you can ignore this email.</p>
+<p><a style="font-weight: bold;" href="{{ .ResetURL }}">Reset my password</a></p>`,
+		PasswordResetEmail{ResetURL: "https://www.readfaster.app/app/auth?email=reader%40example.com&ts=0&verify=0"})
+
+	registerEmail(emailDigest, emailCategoryDigest, "Your reading week of {{ .WeekOf }}", `Here's your reading for the week of {{ .WeekOf }}.
+
+Time read: {{ .Minutes }} minutes over {{ .Sessions }} sessions (last week: {{ .PreviousMinutes }} minutes)
+Current streak: {{ .StreakDays }} days
+
+{{ .AppURL }}
+`, `<p>Here's your reading for the week of {{ .WeekOf }}.</p>
+<p><strong>{{ .Minutes }} minutes</strong> over {{ .Sessions }} sessions (last week: {{ .PreviousMinutes }} minutes)<br/>
+Current streak: <strong>{{ .StreakDays }} days</strong></p>
+<p><a style="font-weight: bold;" href="{{ .AppURL }}">Open ReadFaster</a></p>`,
+		DigestEmail{WeekOf: "March 2", Minutes: 185, Sessions: 6, StreakDays: 4, PreviousMinutes: 140, AppURL: "https://www.readfaster.app/app"})
+
+	registerEmail(emailDeleteAccount, "", "Confirm ReadFaster account deletion", `We received a request to delete your ReadFaster account and all of its data.
+
+Click on the following link within an hour to confirm. If you didn't ask for this, you can ignore this email.
+
+{{ .ConfirmURL }}
+`, `<p>We received a request to delete your ReadFaster account and all of its data.</p>
+<p>Click on the following link within an hour to confirm. If you didn't ask for this, you can ignore this email.</p>
+<p><a style="font-weight: bold;" href="{{ .ConfirmURL }}">Delete my account</a></p>`,
+		DeleteAccountEmail{ConfirmURL: "https://www.readfaster.app/app/account/delete?ts=0&user=0&verify=0"})
+
+	registerEmail(emailChangeEmail, "", "Confirm your new ReadFaster email address", `Click on the following link to confirm your new email address for ReadFaster.
+
+{{ .ConfirmURL }}
+`, `<p>Click on the following link to confirm your new email address for ReadFaster:
+
+	<a style="font-weight: bold;" href="{{ .ConfirmURL }}">Confirm email address</a></p>`,
+		ChangeEmailEmail{ConfirmURL: "https://www.readfaster.app/app/email/confirm?email=new%40example.com&ts=0&user=0&verify=0"})
+
+	registerEmail(emailEmailChanged, "", "Your ReadFaster email address was changed", `The email address for your ReadFaster account was changed to {{ .NewEmail }}.
+
+If you didn't make this change, please reply to this email.`, `<p>The email address for your ReadFaster account was changed to <strong>{{ .NewEmail }}</strong>.</p>
+<p>If you didn't make this change, please reply to this email.</p>`,
+		EmailChangedEmail{NewEmail: "new@example.com"})
+
+	registerEmail(emailLaunchConfirm, "", "Confirm your ReadFaster launch subscription", `Thanks for your interest in ReadFaster! Click on the following link to confirm that you'd like to hear when we launch.
+
+{{ .ConfirmURL }}
+
+If you didn't ask for this, you can ignore this email or unsubscribe:
+{{ .UnsubscribeURL }}
+`, `<p>Thanks for your interest in ReadFaster! Click on the following link to confirm that you'd like to hear when we launch:
+
+	<a style="font-weight: bold;" href="{{ .ConfirmURL }}">Confirm subscription</a></p>
+<p>If you didn't ask for this, you can ignore this email or <a href="{{ .UnsubscribeURL }}">unsubscribe</a>.</p>`,
+		LaunchConfirmEmail{
+			ConfirmURL:     "https://www.readfaster.app/launch-subscribe/confirm?email=reader%40example.com&ts=0&verify=0",
+			UnsubscribeURL: "https://www.readfaster.app/launch-subscribe/unsubscribe?email=reader%40example.com&verify=0",
 		})
-		if err != nil {
-			return err
-		}
-		htmlContent = string(buf.Bytes())
+
+	registerEmail(emailReminder, emailCategoryReminders, `{{ if .StreakDays }}Keep your {{ .StreakDays }}-day reading streak going{{ else }}Time to read{{ end }}`,
+		`{{ if .StreakDays }}You've read {{ .StreakDays }} days in a row. A few minutes today keeps the streak alive!{{ else }}You haven't logged any reading today. How about a few pages?{{ end }}
+
+{{ .AppURL }}
+`, `<p>{{ if .StreakDays }}You've read {{ .StreakDays }} days in a row. A few minutes today keeps the streak alive!{{ else }}You haven't logged any reading today. How about a few pages?{{ end }}</p>
+<p><a style="font-weight: bold;" href="{{ .AppURL }}">Start reading</a></p>`,
+		ReminderEmail{StreakDays: 5, AppURL: "https://www.readfaster.app/app"})
+
+	registerEmail(emailReadingLogged, "", "Logged {{ .Minutes }} minutes of reading", `Got it! We logged {{ .Minutes }} minutes of reading{{ if .Title }} of {{ .Title }}{{ end }}.
+
+{{ .AppURL }}
+`, `<p>Got it! We logged {{ .Minutes }} minutes of reading{{ if .Title }} of <em>{{ .Title }}</em>{{ end }}.</p>
+<p><a style="font-weight: bold;" href="{{ .AppURL }}">See your progress</a></p>`,
+		ReadingLoggedEmail{Minutes: 45, Title: "Dune", AppURL: "https://www.readfaster.app/app"})
+
+	registerEmail(emailReadingNotUnderstood, "", "We couldn't log your reading", `Sorry, we couldn't find a reading time in your email.
+
+Reply with something like "read 25 min", "45m Dune" or "1h 20m".
+`, `<p>Sorry, we couldn't find a reading time in your email.</p>
+<p>Reply with something like &ldquo;read 25 min&rdquo;, &ldquo;45m Dune&rdquo; or &ldquo;1h 20m&rdquo;.</p>`,
+		ReadingNotUnderstoodEmail{})
+
+	announcementSample := "ReadFaster is **live**! Here's what's new:\n\n- Track reading sessions\n- Sync progress to [Goodreads](https://www.goodreads.com)"
+	registerEmail(emailAnnouncement, emailCategoryAnnouncements, "{{ .Subject }}", `{{ .Text }}
+`, `{{ .HTML }}`,
+		AnnouncementEmail{
+			Subject: "ReadFaster has launched",
+			Text:    announcementSample,
+			HTML:    template.HTML(renderMarkdown(announcementSample)),
+		})
+}
+
+// emailKindNames returns the registered template names in order.
+func emailKindNames() []string {
+	names := []string{}
+	for name := range emailKinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// renderEmail renders the named template with data, which must be of the
+// template's data type, into the standard layout. unsubscribeURL is linked
+// in the footer if set.
+func renderEmail(baseURL, unsubscribeURL, to, name string, data interface{}) (*Message, error) {
+	kind, ok := emailKinds[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown email template %q", name)
+	}
+	if reflect.TypeOf(data) != reflect.TypeOf(kind.sample) {
+		return nil, fmt.Errorf("email template %q needs %T, got %T", name, kind.sample, data)
+	}
+
+	subject := &bytes.Buffer{}
+	err := kind.subject.Execute(subject, data)
+	if err != nil {
+		return nil, err
+	}
+	content := &bytes.Buffer{}
+	err = kind.text.Execute(content, data)
+	if err != nil {
+		return nil, err
+	}
+	htmlContent := &bytes.Buffer{}
+	err = kind.html.Execute(htmlContent, data)
+	if err != nil {
+		return nil, err
 	}
 
-	buf := &bytes.Buffer{}
-	err := textTemplate.Execute(buf, map[string]interface{}{
-		"Content": content,
+	text := &bytes.Buffer{}
+	err = textLayout.Execute(text, map[string]interface{}{
+		"Content":        content.String(),
+		"BaseURL":        baseURL,
+		"UnsubscribeURL": unsubscribeURL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	html := &bytes.Buffer{}
+	err = htmlLayout.Execute(html, map[string]interface{}{
+		"HTMLContent":    template.HTML(htmlContent.String()),
+		"BaseURL":        baseURL,
+		"UnsubscribeURL": unsubscribeURL,
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		To:      to,
+		Subject: subject.String(),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// sendMail queues an email for delivery by the outbox worker.
+func (api *API) sendMail(to, name string, data interface{}) error {
+	_, err := api.sendMailTx(api.db, to, name, data)
 	if err != nil {
 		return err
 	}
-	content = string(buf.Bytes())
+	api.wakeOutbox()
+	return nil
+}
+
+// sendMailTx queues an email as part of q, which may be a transaction, and
+// returns its outbox ID. Callers should call wakeOutbox after committing.
+// Emails in a category are dropped, returning 0, if the recipient opted out
+// or the address bounced or complained before, and the others get
+// unsubscribe links.
+func (api *API) sendMailTx(q execer, to, name string, data interface{}) (int64, error) {
+	kind, ok := emailKinds[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown email template %q", name)
+	}
+
+	unsubscribeURL := ""
+	if kind.category != "" {
+		userID, enabled, err := api.emailPreference(to, kind.category)
+		if err != nil {
+			return 0, err
+		}
+		if !enabled {
+			return 0, nil
+		}
+		suppressed, err := api.isSuppressed(to)
+		if err != nil {
+			return 0, err
+		}
+		if suppressed {
+			return 0, nil
+		}
+		if userID != "" {
+			unsubscribeURL = api.unsubscribeLink(userID, kind.category)
+		} else if kind.category == emailCategoryAnnouncements {
+			// Launch subscribers without an account.
+			unsubscribeURL = api.launchUnsubscribeLink(to)
+		}
+	}
 
-	if api.devMode {
-		log.Println("Email")
-		log.Println("===")
-		log.Println("To:", to)
-		log.Println("Subject:", subject)
-		log.Println("Content:", content)
-		if htmlContent != "" {
-			log.Println("HTML Content:", htmlContent)
+	msg, err := renderEmail(api.baseURL, unsubscribeURL, to, name, data)
+	if err != nil {
+		return 0, err
+	}
+	if unsubscribeURL != "" {
+		msg.Headers = map[string]string{
+			"List-Unsubscribe":      "<" + unsubscribeURL + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
 		}
-		return nil
 	}
+	return enqueueMail(q, msg, emailLinkTTLs[name])
+}
+
+func (api *API) HandleAPIAdminGetEmailTemplates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(emailKindNames())
+}
 
-	msg := api.mg.NewMessage("ReadFaster <noreply@mg.readfaster.app>", subject, content, to)
-	msg.SetReplyTo("Preetam <readfaster@preet.am>")
-	msg.SetHtml(htmlContent)
+// HandleAPIAdminGetEmailPreview renders a template with its sample data. With
+// ?format=html or ?format=text it returns just that part for viewing in a
+// browser.
+func (api *API) HandleAPIAdminGetEmailPreview(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	kind, ok := emailKinds[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	unsubscribeURL := ""
+	if kind.category != "" {
+		unsubscribeURL = api.baseURL + "/app/unsubscribe"
+	}
+	msg, err := renderEmail(api.baseURL, unsubscribeURL, "reader@example.com", name, kind.sample)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
-	_, _, err = api.mg.Send(ctx, msg)
-	return err
+	switch r.URL.Query().Get("format") {
+	case "html":
+		w.Header().Add("content-type", "text/html; charset=utf-8")
+		w.Write([]byte(msg.HTML))
+	case "text":
+		w.Header().Add("content-type", "text/plain; charset=utf-8")
+		w.Write([]byte(msg.Text))
+	default:
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"subject": msg.Subject,
+			"text":    msg.Text,
+			"html":    msg.HTML,
+		})
+	}
 }
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderEmail(t *testing.T) {
+	for _, name := range emailKindNames() {
+		msg, err := renderEmail("https://rfa.example", "", "reader@example.com", name, emailKinds[name].sample)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if msg.Subject == "" || msg.Text == "" || msg.HTML == "" {
+			t.Errorf("%s: empty part in %+v", name, msg)
+		}
+		if !strings.Contains(msg.HTML, "https://rfa.example/img/logo-dark.png") {
+			t.Errorf("%s: layout doesn't use the base URL", name)
+		}
+	}
+
+	msg, err := renderEmail("https://rfa.example", "", "reader@example.com", emailLoginLink,
+		LoginLinkEmail{LoginURL: "https://rfa.example/app/auth?email=a%40b.c&ts=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg.Text, "https://rfa.example/app/auth?email=a%40b.c&ts=1") {
+		t.Errorf("text part should contain the unescaped link:\n%s", msg.Text)
+	}
+
+	_, err = renderEmail("https://rfa.example", "", "reader@example.com", emailLoginLink, WelcomeEmail{})
+	if err == nil {
+		t.Error("expected an error for the wrong data type")
+	}
+}
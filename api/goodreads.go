@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/xml"
@@ -9,17 +10,65 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/gomodule/oauth1/oauth"
 	"github.com/gorilla/mux"
 )
 
-var (
-	goodreadsCredentialsContextKey = "rfa_goodreads_creds"
-	goodreadsUserIDContextKey      = "rfa_goodreads_user_id"
+const (
+	// goodreadsRecheckInterval is how long a stored Goodreads user ID is
+	// trusted before auth_user is called again.
+	goodreadsRecheckInterval = 24 * time.Hour
+	goodreadsBrokenMessage   = "Your Goodreads connection stopped working. Please reconnect it."
 )
 
+var goodreadsLinkContextKey = "rfa_goodreads_link"
+
+// A goodreadsLink is a user's connection to their Goodreads account.
+// GoodreadsUserID and Name are empty until auth_user has succeeded.
+type goodreadsLink struct {
+	UserID          string
+	Creds           *oauth.Credentials
+	GoodreadsUserID string
+	Name            string
+	CheckedAt       time.Time
+}
+
+func (link *goodreadsLink) stale(now time.Time) bool {
+	return link.GoodreadsUserID == "" || now.Sub(link.CheckedAt) > goodreadsRecheckInterval
+}
+
+// isGoodreadsRevoked reports whether Goodreads rejected the access token,
+// which happens when the user revokes ReadFaster's access.
+func isGoodreadsRevoked(err error) bool {
+	grErr, ok := err.(*GoodreadsError)
+	return ok && grErr.StatusCode == http.StatusUnauthorized
+}
+
+// goodreadsErrorStatus returns the status for a failed Goodreads request.
+// Requests the scheduler turned away get a 503 so clients back off.
+func goodreadsErrorStatus(err error) int {
+	if err == errGoodreadsBusy {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// markGoodreadsBroken records that the link's token was rejected, so the
+// user is asked to reconnect instead of seeing errors, and responds with 409.
+func (api *API) markGoodreadsBroken(w http.ResponseWriter, r *http.Request, link *goodreadsLink) {
+	result, err := api.db.Exec("UPDATE goodreads_tokens SET broken_at = now() WHERE user_id = $1 AND token = $2 AND broken_at IS NULL",
+		link.UserID, link.Creds.Token)
+	if err != nil {
+		log.Println(err)
+	} else if n, _ := result.RowsAffected(); n > 0 {
+		api.audit(r, link.UserID, auditGoodreadsBroken, "")
+	}
+	http.Error(w, goodreadsBrokenMessage, http.StatusConflict)
+}
+
 func (api *API) WithGoodreadsCredentials(f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userIDVal := r.Context().Value(userIDContextKey)
@@ -30,47 +79,97 @@ func (api *API) WithGoodreadsCredentials(f func(w http.ResponseWriter, r *http.R
 		}
 		userID := userIDVal.(string)
 
-		creds := &oauth.Credentials{}
-		err := api.db.QueryRow("SELECT token, secret FROM goodreads_tokens WHERE user_id = $1", userID).
-			Scan(&creds.Token, &creds.Secret)
+		link := &goodreadsLink{UserID: userID, Creds: &oauth.Credentials{}}
+		checkedAt := sql.NullTime{}
+		broken := false
+		err := api.db.QueryRow(`SELECT token, secret, goodreads_user_id, name, checked_at, broken_at IS NOT NULL
+			FROM goodreads_tokens WHERE user_id = $1`, userID).
+			Scan(&link.Creds.Token, &link.Creds.Secret, &link.GoodreadsUserID, &link.Name, &checkedAt, &broken)
 		if err != nil {
 			http.Error(w, "missing Goodreads token", http.StatusUnauthorized)
 			return
 		}
-		f(w, r.WithContext(context.WithValue(r.Context(), goodreadsCredentialsContextKey, creds)))
+		if broken {
+			http.Error(w, goodreadsBrokenMessage, http.StatusConflict)
+			return
+		}
+		link.CheckedAt = checkedAt.Time
+		f(w, r.WithContext(context.WithValue(r.Context(), goodreadsLinkContextKey, link)))
 	}
 }
 
 type goodreadsAuthUserResponse struct {
 	XMLName xml.Name `xml:"GoodreadsResponse"`
 	User    struct {
-		ID string `xml:"id,attr"`
+		ID   string `xml:"id,attr"`
+		Name string `xml:"name"`
 	} `xml:"user"`
 }
 
+// fetchGoodreadsUser asks Goodreads who creds belong to.
+func (api *API) fetchGoodreadsUser(ctx context.Context, creds *oauth.Credentials) (id, name string, err error) {
+	resp, err := api.goodreads.Get(ctx, creds, "/api/auth_user", nil)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	authUserResponse := goodreadsAuthUserResponse{}
+	err = xml.NewDecoder(resp.Body).Decode(&authUserResponse)
+	if err != nil {
+		return "", "", err
+	}
+	if authUserResponse.User.ID == "" {
+		return "", "", fmt.Errorf("goodreads: auth_user returned no user ID")
+	}
+	return authUserResponse.User.ID, authUserResponse.User.Name, nil
+}
+
+// WithGoodreadsUserID makes sure the link has a Goodreads user ID,
+// refreshing the stored one if it's missing or hasn't been checked
+// recently. If Goodreads is down, a stored ID is used as is.
 func (api *API) WithGoodreadsUserID(f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		credsVal := r.Context().Value(goodreadsCredentialsContextKey)
-		if credsVal == nil {
+		linkVal := r.Context().Value(goodreadsLinkContextKey)
+		if linkVal == nil {
 			http.Error(w, "missing Goodreads token", http.StatusUnauthorized)
 			return
 		}
-		creds := credsVal.(*oauth.Credentials)
+		link := linkVal.(*goodreadsLink)
 
-		resp, err := api.goodreads.Get(nil, creds, "https://www.goodreads.com/api/auth_user", nil)
-		if err != nil {
-			http.Error(w, "Internal server error", 500)
+		now := time.Now()
+		if !link.stale(now) {
+			f(w, r)
 			return
 		}
 
-		authUserResponse := goodreadsAuthUserResponse{}
-		err = xml.NewDecoder(resp.Body).Decode(&authUserResponse)
+		id, name, err := api.fetchGoodreadsUser(r.Context(), link.Creds)
 		if err != nil {
-			http.Error(w, "Internal server error: "+err.Error(), 500)
+			if isGoodreadsRevoked(err) {
+				api.markGoodreadsBroken(w, r, link)
+				return
+			}
+			log.Println(err)
+			if link.GoodreadsUserID == "" && err == errGoodreadsBusy {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			if link.GoodreadsUserID == "" {
+				http.Error(w, "Goodreads is unavailable", http.StatusBadGateway)
+				return
+			}
+			f(w, r)
 			return
 		}
 
-		f(w, r.WithContext(context.WithValue(r.Context(), goodreadsUserIDContextKey, authUserResponse.User.ID)))
+		_, err = api.db.Exec("UPDATE goodreads_tokens SET goodreads_user_id = $2, name = $3, checked_at = $4 WHERE user_id = $1",
+			link.UserID, id, name, now)
+		if err != nil {
+			log.Println(err)
+		}
+		refreshed := *link
+		refreshed.GoodreadsUserID, refreshed.Name, refreshed.CheckedAt = id, name, now
+		f(w, r.WithContext(context.WithValue(r.Context(), goodreadsLinkContextKey, &refreshed)))
 	}
 }
 
@@ -82,14 +181,11 @@ func (api *API) HandleGoodreadsAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	callbackURL := "https://www.readfaster.app/goodreads/callback"
-	if api.devMode {
-		callbackURL = "http://" + r.Host + "/goodreads/callback"
-	}
+	callbackURL := api.origin(r) + "/goodreads/callback"
 
-	tempCred, err := api.goodreads.RequestTemporaryCredentials(nil, callbackURL, nil)
+	tempCred, err := api.goodreads.RequestTemporaryCredentials(r.Context(), callbackURL)
 	if err != nil {
-		http.Error(w, "Error getting temp cred, "+err.Error(), 500)
+		http.Error(w, "Error getting temp cred, "+err.Error(), goodreadsErrorStatus(err))
 		return
 	}
 
@@ -107,11 +203,10 @@ func (api *API) HandleGoodreadsAuth(w http.ResponseWriter, r *http.Request) {
 		Expires:  time.Now().Add(7 * 24 * time.Hour),
 		Secure:   !api.devMode,
 		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
 	})
 
-	http.Redirect(w, r, api.goodreads.AuthorizationURL(tempCred, map[string][]string{
-		"oauth_callback": {callbackURL},
-	}), 302)
+	http.Redirect(w, r, api.goodreads.AuthorizationURL(tempCred, callbackURL), 302)
 }
 
 func (api *API) HandleGoodreadsCallback(w http.ResponseWriter, r *http.Request) {
@@ -149,18 +244,29 @@ func (api *API) HandleGoodreadsCallback(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	tokenCred, _, err := api.goodreads.RequestToken(nil, tempCred, r.FormValue("oauth_verifier"))
+	tokenCred, err := api.goodreads.RequestToken(r.Context(), tempCred, r.FormValue("oauth_verifier"))
 	if err != nil {
-		http.Error(w, "Error getting request token, "+err.Error(), 500)
+		http.Error(w, "Error getting request token, "+err.Error(), goodreadsErrorStatus(err))
 		return
 	}
 
-	_, err = api.db.Exec("INSERT INTO goodreads_tokens (user_id, token, secret) VALUES ($1, $2, $3) ON CONFLICT (user_id) DO UPDATE SET token = $2, secret = $3",
-		userID, tokenCred.Token, tokenCred.Secret)
+	// The user ID is fetched lazily later if Goodreads doesn't answer now.
+	goodreadsUserID, name, err := api.fetchGoodreadsUser(r.Context(), tokenCred)
+	checkedAt := sql.NullTime{Time: time.Now(), Valid: err == nil}
+	if err != nil {
+		log.Println(err)
+	}
+
+	_, err = api.db.Exec(`INSERT INTO goodreads_tokens (user_id, token, secret, goodreads_user_id, name, checked_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id) DO UPDATE SET token = $2, secret = $3, goodreads_user_id = $4, name = $5, checked_at = $6, broken_at = NULL`,
+		userID, tokenCred.Token, tokenCred.Secret, goodreadsUserID, name, checkedAt)
 	if err != nil {
 		http.Error(w, "error saving token, "+err.Error(), 500)
 		return
 	}
+	api.goodreadsCache.invalidate(userID)
+	api.audit(r, userID, auditGoodreadsConnected, "")
 
 	http.Redirect(w, r, "/app", 302)
 }
@@ -207,110 +313,229 @@ type GoodreadsBook struct {
 		Page    int `json:"page"`
 		Percent int `json:"percent"`
 	} `json:"progress"`
+	// ProgressUnavailable is set if the book's review couldn't be fetched.
+	ProgressUnavailable bool `json:"progress_unavailable,omitempty"`
 }
 
+const (
+	goodreadsCacheTTL                = 5 * time.Minute
+	goodreadsMaxConcurrentPerRequest = 2
+)
+
+// goodreadsCache keeps each user's currently-reading books in memory so
+// reloading the page doesn't cost a Goodreads request per book.
+type goodreadsCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]goodreadsCacheEntry
+	// generations counts each user's invalidations, so a fetch that
+	// started before one doesn't cache what it read.
+	generations map[string]uint64
+}
+
+type goodreadsCacheEntry struct {
+	books   []GoodreadsBook
+	expires time.Time
+}
+
+func newGoodreadsCache(ttl time.Duration) *goodreadsCache {
+	return &goodreadsCache{
+		ttl:         ttl,
+		entries:     map[string]goodreadsCacheEntry{},
+		generations: map[string]uint64{},
+	}
+}
+
+// get returns the user's cached books, if any, and the generation to pass
+// to set after fetching them.
+func (c *goodreadsCache) get(userID string, now time.Time) ([]GoodreadsBook, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	generation := c.generations[userID]
+	entry, ok := c.entries[userID]
+	if !ok || !now.Before(entry.expires) {
+		return nil, generation, false
+	}
+	return entry.books, generation, true
+}
+
+// set caches books unless the user's cache was invalidated since get
+// returned generation.
+func (c *goodreadsCache) set(userID string, generation uint64, books []GoodreadsBook, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generations[userID] != generation {
+		return
+	}
+	for id, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, id)
+		}
+	}
+	c.entries[userID] = goodreadsCacheEntry{books: books, expires: now.Add(c.ttl)}
+}
+
+func (c *goodreadsCache) invalidate(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, userID)
+	c.generations[userID]++
+}
+
+// fetchGoodreadsProgress sets book's progress from the latest status on
+// the review.
+func (api *API) fetchGoodreadsProgress(ctx context.Context, creds *oauth.Credentials, reviewID int, book *GoodreadsBook) error {
+	resp, err := api.goodreads.Get(ctx, creds, "/review/show.xml", url.Values{
+		"id": []string{fmt.Sprint(reviewID)},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	reviewResponse := goodreadsReviewResponse{}
+	err = xml.NewDecoder(resp.Body).Decode(&reviewResponse)
+	if err != nil {
+		return err
+	}
+	if len(reviewResponse.Review.UserStatuses.UserStatus) > 0 {
+		status := reviewResponse.Review.UserStatuses.UserStatus[0]
+		book.Progress.Page = status.Page
+		book.Progress.Percent = status.Percent
+	}
+	return nil
+}
+
+// HandleAPIGetGoodreadsReviews lists the books on the user's
+// currently-reading shelf. Reviews are fetched concurrently through the
+// shared scheduler. If some of them fail, the rest are still returned with
+// "partial" set, and the result isn't cached.
 func (api *API) HandleAPIGetGoodreadsReviews(w http.ResponseWriter, r *http.Request) {
-	credsVal := r.Context().Value(goodreadsCredentialsContextKey)
-	if credsVal == nil {
+	linkVal := r.Context().Value(goodreadsLinkContextKey)
+	if linkVal == nil {
 		http.Error(w, "missing Goodreads token", http.StatusUnauthorized)
 		return
 	}
-	creds := credsVal.(*oauth.Credentials)
-
-	goodreadsUserIDVal := r.Context().Value(goodreadsUserIDContextKey)
-	if goodreadsUserIDVal == nil {
+	link := linkVal.(*goodreadsLink)
+	creds := link.Creds
+	if link.GoodreadsUserID == "" {
 		http.Error(w, "missing Goodreads user ID", http.StatusUnauthorized)
 		return
 	}
-	goodreadsUserID := goodreadsUserIDVal.(string)
 
-	resp, err := api.goodreads.Get(nil, creds,
-		fmt.Sprintf("https://www.goodreads.com/review/list/%s.xml", goodreadsUserID), url.Values{
+	books, generation, ok := api.goodreadsCache.get(link.UserID, time.Now())
+	if ok {
+		writeGoodreadsBooks(w, books, false)
+		return
+	}
+
+	resp, err := api.goodreads.Get(r.Context(), creds,
+		fmt.Sprintf("/review/list/%s.xml", url.PathEscape(link.GoodreadsUserID)), url.Values{
 			"v":     []string{"2"},
 			"shelf": []string{"currently-reading"},
 		})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if isGoodreadsRevoked(err) {
+			api.markGoodreadsBroken(w, r, link)
+			return
+		}
+		http.Error(w, err.Error(), goodreadsErrorStatus(err))
 		return
 	}
 
 	goodreadsResponse := goodreadsReviewListResponse{}
 	err = xml.NewDecoder(resp.Body).Decode(&goodreadsResponse)
+	resp.Body.Close()
 	if err != nil {
 		http.Error(w, "Internal server error: "+err.Error(), 500)
 		return
 	}
 
-	books := []GoodreadsBook{}
-	for _, review := range goodreadsResponse.Reviews.Review {
+	reviews := goodreadsResponse.Reviews.Review
+	books = make([]GoodreadsBook, len(reviews))
+	errs := make([]error, len(reviews))
+	wg := sync.WaitGroup{}
+	// Each request only takes a few of the scheduler's slots, so one
+	// long shelf doesn't hold up everyone else.
+	workers := make(chan struct{}, goodreadsMaxConcurrentPerRequest)
+	for i, review := range reviews {
 		book := review.Book
 		authors := []string{}
 		for _, author := range book.Authors.Author {
 			authors = append(authors, author.Name)
 		}
-
-		reviewResponse := goodreadsReviewResponse{}
-		resp, err = api.goodreads.Get(nil, creds,
-			fmt.Sprintf("https://www.goodreads.com/review/show.xml"), url.Values{
-				"id": []string{fmt.Sprint(review.ID)},
-			})
-		if err != nil {
-			http.Error(w, "Internal server error: "+err.Error(), 500)
-			return
-		}
-		err = xml.NewDecoder(resp.Body).Decode(&reviewResponse)
-		if err != nil {
-			http.Error(w, "Internal server error: "+err.Error(), 500)
-			return
-		}
-
-		bookResponse := GoodreadsBook{
+		books[i] = GoodreadsBook{
 			ID:       book.ID,
 			Title:    book.Title,
 			ImageURL: book.ImageURL,
 			NumPages: book.NumPages,
 			Authors:  authors,
 		}
-		if len(reviewResponse.Review.UserStatuses.UserStatus) > 0 {
-			status := reviewResponse.Review.UserStatuses.UserStatus[0]
-			bookResponse.Progress.Page = status.Page
-			bookResponse.Progress.Percent = status.Percent
-		}
 
-		books = append(books, bookResponse)
+		wg.Add(1)
+		go func(i, reviewID int) {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			errs[i] = api.fetchGoodreadsProgress(r.Context(), creds, reviewID, &books[i])
+		}(i, review.ID)
 	}
+	wg.Wait()
 
+	partial := false
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if isGoodreadsRevoked(err) {
+			api.markGoodreadsBroken(w, r, link)
+			return
+		}
+		log.Printf("goodreads review %d: %v", reviews[i].ID, err)
+		books[i].ProgressUnavailable = true
+		partial = true
+	}
+	if !partial {
+		api.goodreadsCache.set(link.UserID, generation, books, time.Now())
+	}
+	writeGoodreadsBooks(w, books, partial)
+}
+
+func writeGoodreadsBooks(w http.ResponseWriter, books []GoodreadsBook, partial bool) {
 	w.Header().Add("content-type", "application/json")
-	w.Header().Add("cache-control", "max-age=60")
+	// Books are cached on the server, where progress updates invalidate them.
+	w.Header().Add("cache-control", "no-cache")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"books": books,
+		"books":   books,
+		"partial": partial,
 	})
 }
 
 func (api *API) HandleAPIPostGoodreadsProgress(w http.ResponseWriter, r *http.Request) {
-	credsVal := r.Context().Value(goodreadsCredentialsContextKey)
-	if credsVal == nil {
+	linkVal := r.Context().Value(goodreadsLinkContextKey)
+	if linkVal == nil {
 		http.Error(w, "missing Goodreads token", http.StatusUnauthorized)
 		return
 	}
-	creds := credsVal.(*oauth.Credentials)
-
-	goodreadsUserIDVal := r.Context().Value(goodreadsUserIDContextKey)
-	if goodreadsUserIDVal == nil {
-		http.Error(w, "missing Goodreads user ID", http.StatusUnauthorized)
-		return
-	}
+	link := linkVal.(*goodreadsLink)
 
 	goodreadsBook := mux.Vars(r)["goodreads_book_id"]
 
-	_, err := api.goodreads.Post(nil, creds,
-		"https://www.goodreads.com/user_status.xml", url.Values{
-			"user_status[book_id]": []string{goodreadsBook},
-			"user_status[percent]": []string{r.URL.Query().Get("percent")},
-		})
+	resp, err := api.goodreads.Post(r.Context(), link.Creds, "/user_status.xml", url.Values{
+		"user_status[book_id]": []string{goodreadsBook},
+		"user_status[percent]": []string{r.URL.Query().Get("percent")},
+	})
 	if err != nil {
+		if isGoodreadsRevoked(err) {
+			api.markGoodreadsBroken(w, r, link)
+			return
+		}
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), goodreadsErrorStatus(err))
 		return
 	}
+	resp.Body.Close()
+	// The cached progress is out of date now.
+	api.goodreadsCache.invalidate(link.UserID)
 }
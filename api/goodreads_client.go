@@ -0,0 +1,288 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/oauth1/oauth"
+)
+
+const (
+	defaultGoodreadsURL = "https://www.goodreads.com"
+	goodreadsTimeout    = 15 * time.Second
+)
+
+// A GoodreadsClient makes OAuth 1.0a requests to Goodreads.
+type GoodreadsClient interface {
+	RequestTemporaryCredentials(ctx context.Context, callbackURL string) (*oauth.Credentials, error)
+	AuthorizationURL(tempCred *oauth.Credentials, callbackURL string) string
+	RequestToken(ctx context.Context, tempCred *oauth.Credentials, verifier string) (*oauth.Credentials, error)
+
+	// Get and Post take paths relative to the base URL, like
+	// "/api/auth_user". Responses other than 2xx are returned as a
+	// *GoodreadsError with the body already closed.
+	Get(ctx context.Context, creds *oauth.Credentials, path string, params url.Values) (*http.Response, error)
+	Post(ctx context.Context, creds *oauth.Credentials, path string, params url.Values) (*http.Response, error)
+}
+
+// A GoodreadsError is an unsuccessful response from Goodreads.
+type GoodreadsError struct {
+	StatusCode int
+	Path       string
+}
+
+func (e *GoodreadsError) Error() string {
+	return fmt.Sprintf("goodreads: %s returned %d", e.Path, e.StatusCode)
+}
+
+type oauthGoodreadsClient struct {
+	baseURL    string
+	oauth      *oauth.Client
+	httpClient *http.Client
+}
+
+// NewGoodreadsClient returns a client for the Goodreads API at baseURL,
+// which defaults to https://www.goodreads.com.
+func NewGoodreadsClient(baseURL, key, secret string) GoodreadsClient {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	if baseURL == "" {
+		baseURL = defaultGoodreadsURL
+	}
+	return &oauthGoodreadsClient{
+		baseURL: baseURL,
+		oauth: &oauth.Client{
+			TemporaryCredentialRequestURI: baseURL + "/oauth/request_token",
+			ResourceOwnerAuthorizationURI: baseURL + "/oauth/authorize",
+			TokenRequestURI:               baseURL + "/oauth/access_token",
+			Credentials: oauth.Credentials{
+				Token:  key,
+				Secret: secret,
+			},
+		},
+		httpClient: &http.Client{Timeout: goodreadsTimeout},
+	}
+}
+
+func (c *oauthGoodreadsClient) context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth.HTTPClient, c.httpClient)
+}
+
+func (c *oauthGoodreadsClient) RequestTemporaryCredentials(ctx context.Context, callbackURL string) (*oauth.Credentials, error) {
+	return c.oauth.RequestTemporaryCredentialsContext(c.context(ctx), callbackURL, nil)
+}
+
+func (c *oauthGoodreadsClient) AuthorizationURL(tempCred *oauth.Credentials, callbackURL string) string {
+	return c.oauth.AuthorizationURL(tempCred, url.Values{
+		"oauth_callback": {callbackURL},
+	})
+}
+
+func (c *oauthGoodreadsClient) RequestToken(ctx context.Context, tempCred *oauth.Credentials, verifier string) (*oauth.Credentials, error) {
+	tokenCred, _, err := c.oauth.RequestTokenContext(c.context(ctx), tempCred, verifier)
+	return tokenCred, err
+}
+
+func (c *oauthGoodreadsClient) Get(ctx context.Context, creds *oauth.Credentials, path string, params url.Values) (*http.Response, error) {
+	resp, err := c.oauth.GetContext(c.context(ctx), creds, c.baseURL+path, params)
+	return checkGoodreadsResponse(path, resp, err)
+}
+
+func (c *oauthGoodreadsClient) Post(ctx context.Context, creds *oauth.Credentials, path string, params url.Values) (*http.Response, error) {
+	resp, err := c.oauth.PostContext(c.context(ctx), creds, c.baseURL+path, params)
+	return checkGoodreadsResponse(path, resp, err)
+}
+
+func checkGoodreadsResponse(path string, resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Drain the body so the connection can be reused.
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+		resp.Body.Close()
+		return nil, &GoodreadsError{StatusCode: resp.StatusCode, Path: path}
+	}
+	return resp, nil
+}
+
+const (
+	// Goodreads asks API clients to make at most one request per second.
+	goodreadsRequestInterval = time.Second
+	goodreadsMaxConcurrent   = 4
+	// Requests that can't start within goodreadsMaxWait fail right away.
+	goodreadsMaxWait = 10 * time.Second
+)
+
+var errGoodreadsBusy = errors.New("goodreads: too many requests queued")
+
+// A goodreadsScheduler is shared by all requests to Goodreads. It starts
+// requests at most once per interval and limits how many are in flight.
+// Each request reserves the next free start time, and gives it back if it's
+// cancelled before starting.
+type goodreadsScheduler struct {
+	interval time.Duration
+	maxWait  time.Duration
+	slots    chan struct{}
+
+	mu   sync.Mutex
+	next time.Time
+	// free holds start times given back before next, earliest first.
+	free []time.Time
+}
+
+func newGoodreadsScheduler(interval, maxWait time.Duration, maxConcurrent int) *goodreadsScheduler {
+	return &goodreadsScheduler{
+		interval: interval,
+		maxWait:  maxWait,
+		slots:    make(chan struct{}, maxConcurrent),
+	}
+}
+
+// acquire blocks until a request may start. It returns errGoodreadsBusy if
+// that's more than maxWait away, without waiting when it can tell up front.
+// The caller must call release once the request is done.
+func (s *goodreadsScheduler) acquire(ctx context.Context) error {
+	limit := time.Now().Add(s.maxWait)
+	slotTimer := time.NewTimer(s.maxWait)
+	select {
+	case s.slots <- struct{}{}:
+		slotTimer.Stop()
+	case <-slotTimer.C:
+		return errGoodreadsBusy
+	case <-ctx.Done():
+		slotTimer.Stop()
+		return ctx.Err()
+	}
+
+	start, ok := s.reserve(time.Now(), limit)
+	if !ok {
+		s.release()
+		return errGoodreadsBusy
+	}
+
+	wait := time.Until(start)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		s.giveBack(start)
+		s.release()
+		return ctx.Err()
+	}
+}
+
+// reserve returns the earliest free start time from now on, unless it's
+// after limit.
+func (s *goodreadsScheduler) reserve(now, limit time.Time) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Times given back that have passed can't be used: starting later
+	// would be too close to the next reservation.
+	for len(s.free) > 0 && s.free[0].Before(now) {
+		s.free = s.free[1:]
+	}
+	if len(s.free) > 0 {
+		if s.free[0].After(limit) {
+			return time.Time{}, false
+		}
+		start := s.free[0]
+		s.free = s.free[1:]
+		return start, true
+	}
+
+	start := now
+	if start.Before(s.next) {
+		start = s.next
+	}
+	if start.After(limit) {
+		return time.Time{}, false
+	}
+	s.next = start.Add(s.interval)
+	return start, true
+}
+
+// giveBack frees a reserved start time for another request.
+func (s *goodreadsScheduler) giveBack(start time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.next.Equal(start.Add(s.interval)) {
+		i := 0
+		for i < len(s.free) && s.free[i].Before(start) {
+			i++
+		}
+		s.free = append(s.free, time.Time{})
+		copy(s.free[i+1:], s.free[i:])
+		s.free[i] = start
+		return
+	}
+	// It was the last reservation, so move next back, along with any
+	// free times right before it.
+	s.next = start
+	for len(s.free) > 0 && s.free[len(s.free)-1].Add(s.interval).Equal(s.next) {
+		s.next = s.free[len(s.free)-1]
+		s.free = s.free[:len(s.free)-1]
+	}
+}
+
+func (s *goodreadsScheduler) release() {
+	<-s.slots
+}
+
+// scheduledGoodreadsClient runs every request through a scheduler.
+type scheduledGoodreadsClient struct {
+	GoodreadsClient
+	scheduler *goodreadsScheduler
+}
+
+func newScheduledGoodreadsClient(client GoodreadsClient, scheduler *goodreadsScheduler) GoodreadsClient {
+	return &scheduledGoodreadsClient{GoodreadsClient: client, scheduler: scheduler}
+}
+
+func (c *scheduledGoodreadsClient) RequestTemporaryCredentials(ctx context.Context, callbackURL string) (*oauth.Credentials, error) {
+	if err := c.scheduler.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.scheduler.release()
+	return c.GoodreadsClient.RequestTemporaryCredentials(ctx, callbackURL)
+}
+
+func (c *scheduledGoodreadsClient) RequestToken(ctx context.Context, tempCred *oauth.Credentials, verifier string) (*oauth.Credentials, error) {
+	if err := c.scheduler.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.scheduler.release()
+	return c.GoodreadsClient.RequestToken(ctx, tempCred, verifier)
+}
+
+// Get and Post hold their slot until the response headers arrive. Bodies
+// are small and read right away.
+func (c *scheduledGoodreadsClient) Get(ctx context.Context, creds *oauth.Credentials, path string, params url.Values) (*http.Response, error) {
+	if err := c.scheduler.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.scheduler.release()
+	return c.GoodreadsClient.Get(ctx, creds, path, params)
+}
+
+func (c *scheduledGoodreadsClient) Post(ctx context.Context, creds *oauth.Credentials, path string, params url.Values) (*http.Response, error) {
+	if err := c.scheduler.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.scheduler.release()
+	return c.GoodreadsClient.Post(ctx, creds, path, params)
+}
@@ -1,6 +1,22 @@
 package api
 
-// TODO
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/oauth1/oauth"
+	"github.com/gorilla/mux"
+)
 
 const authUserResponse = `
 <?xml version="1.0" encoding="UTF-8"?>
@@ -10,4 +26,620 @@ const authUserResponse = `
   <user id="1234567">
   <name>Preetam</name>
   <link><![CDATA[https://www.goodreads.com/user/show/1234567-preetam?utm_medium=api]]></link>
-</user>`
+</user>
+</GoodreadsResponse>`
+
+const reviewListResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<GoodreadsResponse>
+  <reviews start="1" end="2" total="2">
+    <review>
+      <id>111</id>
+      <book>
+        <id>42</id>
+        <title>Dune</title>
+        <image_url>https://images.example.com/dune.jpg</image_url>
+        <num_pages>412</num_pages>
+        <authors><author><name>Frank Herbert</name></author></authors>
+      </book>
+    </review>
+    <review>
+      <id>222</id>
+      <book>
+        <id>43</id>
+        <title>Good Omens</title>
+        <num_pages>288</num_pages>
+        <authors>
+          <author><name>Terry Pratchett</name></author>
+          <author><name>Neil Gaiman</name></author>
+        </authors>
+      </book>
+    </review>
+  </reviews>
+</GoodreadsResponse>`
+
+const reviewShowResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<GoodreadsResponse>
+  <review>
+    <id>111</id>
+    <user_statuses>
+      <user_status><page>120</page><percent>29</percent></user_status>
+      <user_status><page>40</page><percent>10</percent></user_status>
+    </user_statuses>
+  </review>
+</GoodreadsResponse>`
+
+const emptyReviewShowResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<GoodreadsResponse>
+  <review><id>222</id><user_statuses></user_statuses></review>
+</GoodreadsResponse>`
+
+// fakeGoodreads is an in-process Goodreads API. It accepts requests signed
+// with the access token "token" and rejects others with 401, like
+// Goodreads does for revoked tokens.
+type fakeGoodreads struct {
+	*httptest.Server
+
+	// delay slows down every response.
+	delay time.Duration
+
+	mu          sync.Mutex
+	requests    []string
+	statuses    []url.Values
+	failReviews map[string]bool
+	inFlight    int
+	maxInFlight int
+}
+
+func newFakeGoodreads(t *testing.T) *fakeGoodreads {
+	f := &fakeGoodreads{failReviews: map[string]bool{}}
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/api/auth_user").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(authUserResponse))
+	})
+	r.Methods("GET").Path("/review/list/1234567.xml").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("v") != "2" || r.FormValue("shelf") != "currently-reading" {
+			t.Errorf("unexpected review list query %s", r.URL.RawQuery)
+		}
+		w.Write([]byte(reviewListResponse))
+	})
+	r.Methods("GET").Path("/review/show.xml").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		fail := f.failReviews[r.FormValue("id")]
+		f.mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		switch r.FormValue("id") {
+		case "111":
+			w.Write([]byte(reviewShowResponse))
+		case "222":
+			w.Write([]byte(emptyReviewShowResponse))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	r.Methods("POST").Path("/oauth/access_token").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("oauth_token=token&oauth_token_secret=token-secret"))
+	})
+	r.Methods("POST").Path("/user_status.xml").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		f.mu.Lock()
+		f.statuses = append(f.statuses, r.PostForm)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><user-status></user-status>`))
+	})
+
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f.mu.Lock()
+		f.requests = append(f.requests, req.Method+" "+req.URL.Path)
+		f.inFlight++
+		if f.inFlight > f.maxInFlight {
+			f.maxInFlight = f.inFlight
+		}
+		f.mu.Unlock()
+		defer func() {
+			f.mu.Lock()
+			f.inFlight--
+			f.mu.Unlock()
+		}()
+		time.Sleep(f.delay)
+
+		if !strings.Contains(req.Header.Get("Authorization"), `oauth_token="token"`) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.ServeHTTP(w, req)
+	}))
+	return f
+}
+
+func (f *fakeGoodreads) client() GoodreadsClient {
+	return NewGoodreadsClient(f.URL, "key", "secret")
+}
+
+func (f *fakeGoodreads) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+func (f *fakeGoodreads) api() *API {
+	return &API{goodreads: f.client(), goodreadsCache: newGoodreadsCache(time.Minute)}
+}
+
+// goodreadsRequest returns a request with a link in its context, as set up
+// by WithGoodreadsCredentials.
+func goodreadsRequest(method, target, token, goodreadsUserID string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	link := &goodreadsLink{
+		UserID:          "user",
+		Creds:           &oauth.Credentials{Token: token, Secret: "token-secret"},
+		GoodreadsUserID: goodreadsUserID,
+		CheckedAt:       time.Now(),
+	}
+	return r.WithContext(context.WithValue(r.Context(), goodreadsLinkContextKey, link))
+}
+
+func TestFetchGoodreadsUser(t *testing.T) {
+	fake := newFakeGoodreads(t)
+	defer fake.Close()
+	api := fake.api()
+
+	id, name, err := api.fetchGoodreadsUser(context.Background(), &oauth.Credentials{Token: "token"})
+	if err != nil || id != "1234567" || name != "Preetam" {
+		t.Errorf("expected user 1234567 Preetam, got %q %q %v", id, name, err)
+	}
+
+	_, _, err = api.fetchGoodreadsUser(context.Background(), &oauth.Credentials{Token: "revoked"})
+	if !isGoodreadsRevoked(err) {
+		t.Errorf("expected a revoked token error, got %v", err)
+	}
+}
+
+func TestGoodreadsLinkStale(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		link  goodreadsLink
+		stale bool
+	}{
+		{goodreadsLink{}, true},
+		{goodreadsLink{GoodreadsUserID: "1234567", CheckedAt: now.Add(-time.Hour)}, false},
+		{goodreadsLink{GoodreadsUserID: "1234567", CheckedAt: now.Add(-2 * goodreadsRecheckInterval)}, true},
+		{goodreadsLink{CheckedAt: now}, true},
+	}
+	for i, c := range cases {
+		if stale := c.link.stale(now); stale != c.stale {
+			t.Errorf("case %d: expected %v, got %v", i, c.stale, stale)
+		}
+	}
+}
+
+func TestWithGoodreadsUserID(t *testing.T) {
+	fake := newFakeGoodreads(t)
+	defer fake.Close()
+	api := fake.api()
+
+	goodreadsUserID := ""
+	handler := api.WithGoodreadsUserID(func(w http.ResponseWriter, r *http.Request) {
+		goodreadsUserID = r.Context().Value(goodreadsLinkContextKey).(*goodreadsLink).GoodreadsUserID
+	})
+
+	// A recently checked ID is used without asking Goodreads.
+	w := httptest.NewRecorder()
+	handler(w, goodreadsRequest("GET", "/api/goodreads/currently_reading", "token", "1234567"))
+	if w.Code != http.StatusOK || goodreadsUserID != "1234567" {
+		t.Errorf("expected user 1234567, got %d %q", w.Code, goodreadsUserID)
+	}
+	if n := fake.requestCount(); n != 0 {
+		t.Errorf("expected no Goodreads requests, got %d", n)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/goodreads/currently_reading", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", w.Code)
+	}
+
+	// While Goodreads is down, a stale ID is better than nothing.
+	fake.Close()
+	stale := goodreadsRequest("GET", "/api/goodreads/currently_reading", "token", "1234567")
+	stale.Context().Value(goodreadsLinkContextKey).(*goodreadsLink).CheckedAt = time.Time{}
+	goodreadsUserID = ""
+	w = httptest.NewRecorder()
+	handler(w, stale)
+	if w.Code != http.StatusOK || goodreadsUserID != "1234567" {
+		t.Errorf("expected the stale user ID, got %d %q", w.Code, goodreadsUserID)
+	}
+
+	goodreadsUserID = ""
+	w = httptest.NewRecorder()
+	handler(w, goodreadsRequest("GET", "/api/goodreads/currently_reading", "token", ""))
+	if w.Code != http.StatusBadGateway || goodreadsUserID != "" {
+		t.Errorf("expected 502 without a user ID, got %d %q", w.Code, goodreadsUserID)
+	}
+}
+
+func TestHandleAPIGetGoodreadsReviews(t *testing.T) {
+	fake := newFakeGoodreads(t)
+	defer fake.Close()
+	api := fake.api()
+
+	w := httptest.NewRecorder()
+	api.HandleAPIGetGoodreadsReviews(w, goodreadsRequest("GET", "/api/goodreads/currently_reading", "token", "1234567"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	response := struct {
+		Books []GoodreadsBook `json:"books"`
+	}{}
+	err := json.NewDecoder(w.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Books) != 2 {
+		t.Fatalf("expected 2 books, got %+v", response.Books)
+	}
+	dune, omens := response.Books[0], response.Books[1]
+	if dune.ID != 42 || dune.Title != "Dune" || dune.NumPages != 412 || dune.ImageURL != "https://images.example.com/dune.jpg" {
+		t.Errorf("unexpected book %+v", dune)
+	}
+	if dune.Progress.Page != 120 || dune.Progress.Percent != 29 {
+		t.Errorf("expected the latest status, got %+v", dune.Progress)
+	}
+	if fmt.Sprint(omens.Authors) != "[Terry Pratchett Neil Gaiman]" || omens.Progress.Page != 0 || omens.ProgressUnavailable {
+		t.Errorf("unexpected book %+v", omens)
+	}
+}
+
+type goodreadsBooksResponse struct {
+	Books   []GoodreadsBook `json:"books"`
+	Partial bool            `json:"partial"`
+}
+
+func getGoodreadsBooks(t *testing.T, api *API) goodreadsBooksResponse {
+	w := httptest.NewRecorder()
+	api.HandleAPIGetGoodreadsReviews(w, goodreadsRequest("GET", "/api/goodreads/currently_reading", "token", "1234567"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	response := goodreadsBooksResponse{}
+	err := json.NewDecoder(w.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestHandleAPIGetGoodreadsReviewsPartial(t *testing.T) {
+	fake := newFakeGoodreads(t)
+	defer fake.Close()
+	fake.failReviews["222"] = true
+	api := fake.api()
+
+	response := getGoodreadsBooks(t, api)
+	if !response.Partial || len(response.Books) != 2 {
+		t.Fatalf("expected partial results for 2 books, got %+v", response)
+	}
+	dune, omens := response.Books[0], response.Books[1]
+	if dune.ProgressUnavailable || dune.Progress.Page != 120 {
+		t.Errorf("expected progress for Dune, got %+v", dune)
+	}
+	if !omens.ProgressUnavailable || omens.Title != "Good Omens" {
+		t.Errorf("expected Good Omens without progress, got %+v", omens)
+	}
+
+	// Partial results aren't cached.
+	before := fake.requestCount()
+	getGoodreadsBooks(t, api)
+	if fake.requestCount() == before {
+		t.Error("expected partial results to be fetched again")
+	}
+}
+
+func TestHandleAPIGetGoodreadsReviewsCache(t *testing.T) {
+	fake := newFakeGoodreads(t)
+	defer fake.Close()
+	api := fake.api()
+
+	getGoodreadsBooks(t, api)
+	if n := fake.requestCount(); n != 3 {
+		t.Errorf("expected 3 requests, got %d", n)
+	}
+	response := getGoodreadsBooks(t, api)
+	if n := fake.requestCount(); n != 3 || len(response.Books) != 2 {
+		t.Errorf("expected cached books, got %d requests and %+v", n, response)
+	}
+
+	r := goodreadsRequest("POST", "/api/goodreads/books/42/progress?percent=30", "token", "1234567")
+	r = mux.SetURLVars(r, map[string]string{"goodreads_book_id": "42"})
+	api.HandleAPIPostGoodreadsProgress(httptest.NewRecorder(), r)
+	getGoodreadsBooks(t, api)
+	if n := fake.requestCount(); n != 7 {
+		t.Errorf("expected the progress update to invalidate the cache, got %d requests", n)
+	}
+}
+
+func TestGoodreadsCache(t *testing.T) {
+	now := time.Now()
+	c := newGoodreadsCache(time.Minute)
+	_, generation, _ := c.get("a", now)
+	c.set("a", generation, []GoodreadsBook{{ID: 1}}, now)
+	if books, _, ok := c.get("a", now.Add(30*time.Second)); !ok || len(books) != 1 {
+		t.Errorf("expected a cached book, got %v %v", books, ok)
+	}
+	if _, _, ok := c.get("a", now.Add(time.Minute)); ok {
+		t.Error("expected the entry to expire")
+	}
+	if _, _, ok := c.get("b", now); ok {
+		t.Error("expected no entry for another user")
+	}
+	c.invalidate("a")
+	if _, _, ok := c.get("a", now); ok {
+		t.Error("expected the entry to be invalidated")
+	}
+}
+
+func TestGoodreadsCacheInvalidatedDuringFetch(t *testing.T) {
+	now := time.Now()
+	c := newGoodreadsCache(time.Minute)
+
+	// A fetch starts, progress is posted, and then the fetch finishes
+	// with what Goodreads had before the update.
+	_, generation, _ := c.get("a", now)
+	c.invalidate("a")
+	c.set("a", generation, []GoodreadsBook{{ID: 1}}, now)
+	if _, _, ok := c.get("a", now); ok {
+		t.Error("expected the stale fetch not to be cached")
+	}
+
+	// Other users' fetches are unaffected.
+	_, generation, _ = c.get("b", now)
+	c.invalidate("a")
+	c.set("b", generation, []GoodreadsBook{{ID: 2}}, now)
+	if _, _, ok := c.get("b", now); !ok {
+		t.Error("expected another user's fetch to be cached")
+	}
+}
+
+func TestGoodreadsScheduler(t *testing.T) {
+	s := newGoodreadsScheduler(20*time.Millisecond, time.Second, 1)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := s.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		s.release()
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("expected requests to be spaced out, took %v", elapsed)
+	}
+
+	// The only slot is taken, so the next request waits until its context
+	// is done.
+	if err := s.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	s.release()
+	if err := s.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.release()
+}
+
+func TestGoodreadsSchedulerBusy(t *testing.T) {
+	s := newGoodreadsScheduler(time.Hour, time.Second, 2)
+	if err := s.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.release()
+
+	// The next start is an hour away, so there's no point waiting.
+	start := time.Now()
+	if err := s.acquire(context.Background()); err != errGoodreadsBusy {
+		t.Errorf("expected %v, got %v", errGoodreadsBusy, err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expected to fail right away, took %v", elapsed)
+	}
+
+	// Waiting for a slot is bounded too.
+	s = newGoodreadsScheduler(time.Millisecond, 10*time.Millisecond, 1)
+	if err := s.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.release()
+	if err := s.acquire(context.Background()); err != errGoodreadsBusy {
+		t.Errorf("expected %v, got %v", errGoodreadsBusy, err)
+	}
+}
+
+func TestGoodreadsSchedulerGivesBackCancelledReservations(t *testing.T) {
+	now := time.Now()
+	s := newGoodreadsScheduler(time.Second, time.Minute, 4)
+	limit := now.Add(time.Minute)
+	first, _ := s.reserve(now, limit)
+	second, _ := s.reserve(now, limit)
+	third, _ := s.reserve(now, limit)
+
+	// A reservation in the middle is reused by the next request.
+	s.giveBack(second)
+	if start, _ := s.reserve(now, limit); !start.Equal(second) {
+		t.Errorf("expected %v to be reused, got %v", second, start)
+	}
+
+	// Giving back the last ones moves the queue back.
+	s.giveBack(second)
+	s.giveBack(third)
+	if start, _ := s.reserve(now, limit); !start.Equal(first.Add(time.Second)) {
+		t.Errorf("expected the queue to move back to %v, got %v", first.Add(time.Second), start)
+	}
+
+	// Cancelling while waiting gives the reservation back.
+	s = newGoodreadsScheduler(time.Hour, 2*time.Hour, 2)
+	if err := s.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.release()
+	next := s.next
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if !s.next.Equal(next) {
+		t.Errorf("expected the cancelled reservation to be given back")
+	}
+}
+
+func TestScheduledGoodreadsClient(t *testing.T) {
+	fake := newFakeGoodreads(t)
+	defer fake.Close()
+	fake.delay = 20 * time.Millisecond
+	client := newScheduledGoodreadsClient(fake.client(), newGoodreadsScheduler(time.Millisecond, time.Second, 2))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(context.Background(), &oauth.Credentials{Token: "token"}, "/api/auth_user", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.requests) != 6 || fake.maxInFlight > 2 {
+		t.Errorf("expected 6 requests with at most 2 in flight, got %d with %d", len(fake.requests), fake.maxInFlight)
+	}
+}
+
+func TestHandleAPIPostGoodreadsProgress(t *testing.T) {
+	fake := newFakeGoodreads(t)
+	defer fake.Close()
+	api := fake.api()
+
+	r := goodreadsRequest("POST", "/api/goodreads/books/42/progress?percent=30", "token", "1234567")
+	r = mux.SetURLVars(r, map[string]string{"goodreads_book_id": "42"})
+	w := httptest.NewRecorder()
+	api.HandleAPIPostGoodreadsProgress(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.statuses) != 1 {
+		t.Fatalf("expected 1 status update, got %d", len(fake.statuses))
+	}
+	status := fake.statuses[0]
+	if status.Get("user_status[book_id]") != "42" || status.Get("user_status[percent]") != "30" {
+		t.Errorf("unexpected status update %v", status)
+	}
+}
+
+// linkGoodreads stores a Goodreads connection for the user.
+func linkGoodreads(t *testing.T, db *sql.DB, userID, token string) {
+	t.Helper()
+	_, err := db.Exec(`INSERT INTO goodreads_tokens (user_id, token, secret, goodreads_user_id, name, checked_at)
+		VALUES ($1, $2, 'token-secret', '1234567', 'Preetam', now())`, userID, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func withUserID(r *http.Request, userID string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userIDContextKey, userID))
+}
+
+func TestRevokedGoodreadsTokenMarksLinkBroken(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	fake := newFakeGoodreads(t)
+	defer fake.Close()
+	api := fake.api()
+	api.db = db
+	userID := createTestUser(t, db, "reader@example.com")
+	linkGoodreads(t, db, userID, "revoked")
+	handler := api.WithGoodreadsCredentials(api.WithGoodreadsUserID(api.HandleAPIGetGoodreadsReviews))
+
+	w := httptest.NewRecorder()
+	handler(w, withUserID(httptest.NewRequest("GET", "/api/goodreads/currently_reading", nil), userID))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected %d, got %d", http.StatusConflict, w.Code)
+	}
+	broken := false
+	err := db.QueryRow("SELECT broken_at IS NOT NULL FROM goodreads_tokens WHERE user_id = $1", userID).Scan(&broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !broken {
+		t.Error("expected the link to be marked broken")
+	}
+	if n := countRows(t, db, "SELECT count(*) FROM audit_events WHERE user_id = $1 AND event = $2", userID, auditGoodreadsBroken); n != 1 {
+		t.Errorf("expected 1 %s event, got %d", auditGoodreadsBroken, n)
+	}
+
+	// Broken links are turned away without asking Goodreads.
+	requests := fake.requestCount()
+	w = httptest.NewRecorder()
+	handler(w, withUserID(httptest.NewRequest("GET", "/api/goodreads/currently_reading", nil), userID))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected %d, got %d", http.StatusConflict, w.Code)
+	}
+	if fake.requestCount() != requests {
+		t.Error("expected no Goodreads requests for a broken link")
+	}
+}
+
+func TestHandleGoodreadsCallback(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	fake := newFakeGoodreads(t)
+	defer fake.Close()
+	api := fake.api()
+	api.db = db
+	userID := createTestUser(t, db, "reader@example.com")
+	// Reconnecting replaces a broken link.
+	linkGoodreads(t, db, userID, "revoked")
+	_, err := db.Exec("UPDATE goodreads_tokens SET goodreads_user_id = '', name = '', broken_at = now() WHERE user_id = $1", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tempCred, err := json.Marshal(&oauth.Credentials{Token: "token", Secret: "temp-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/goodreads/callback?oauth_token=token&oauth_verifier=verifier", nil)
+	r.AddCookie(&http.Cookie{Name: "rfa_goodreads_token", Value: base64.StdEncoding.EncodeToString(tempCred)})
+	w := httptest.NewRecorder()
+	api.HandleGoodreadsCallback(w, withUserID(r, userID))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected %d, got %d: %s", http.StatusFound, w.Code, w.Body)
+	}
+
+	token, goodreadsUserID, name := "", "", ""
+	broken := true
+	err = db.QueryRow(`SELECT token, goodreads_user_id, name, broken_at IS NOT NULL
+		FROM goodreads_tokens WHERE user_id = $1`, userID).Scan(&token, &goodreadsUserID, &name, &broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "token" || goodreadsUserID != "1234567" || name != "Preetam" || broken {
+		t.Errorf("unexpected link %q %q %q broken=%v", token, goodreadsUserID, name, broken)
+	}
+}
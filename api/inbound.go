@@ -0,0 +1,273 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	inboundMaxSize = 10 << 20
+	// Sessions longer than this are almost certainly typos.
+	inboundMaxDuration = 12 * time.Hour
+	// Tokens are kept well past the signature's max age to catch replays.
+	inboundTokenMaxAge = 30 * 24 * time.Hour
+)
+
+var errInboundSignature = errors.New("inbound: bad signature")
+
+// An inboundEmail is a message forwarded by a Mailgun route.
+type inboundEmail struct {
+	Sender  string
+	Subject string
+	Text    string
+	Token   string
+	// Authenticated is set if SPF or DKIM vouch for Sender.
+	Authenticated bool
+}
+
+// parseInboundEmail reads a Mailgun route POST, which may be urlencoded or
+// multipart, and checks its signature.
+func (api *API) parseInboundEmail(r *http.Request) (*inboundEmail, error) {
+	err := r.ParseMultipartForm(inboundMaxSize)
+	if err != nil && err != http.ErrNotMultipart {
+		return nil, err
+	}
+	if !verifyMailgunSignature(api.mailgunWebhookKey, r.FormValue("timestamp"), r.FormValue("token"), r.FormValue("signature")) {
+		return nil, errInboundSignature
+	}
+
+	sender := r.FormValue("sender")
+	if addr, err := mail.ParseAddress(sender); err == nil {
+		sender = addr.Address
+	}
+	// stripped-text leaves out quoted replies and signatures.
+	text := r.FormValue("stripped-text")
+	if strings.TrimSpace(text) == "" {
+		text = r.FormValue("body-plain")
+	}
+	return &inboundEmail{
+		Sender:        sender,
+		Subject:       r.FormValue("subject"),
+		Text:          text,
+		Token:         r.FormValue("token"),
+		Authenticated: inboundSenderAuthenticated(sender, r.FormValue("message-headers")),
+	}, nil
+}
+
+// inboundSenderAuthenticated reports whether Mailgun's checks vouch for
+// sender, given the message-headers field: a JSON list of [name, value]
+// pairs. sender is the envelope sender, which is what SPF checks. A DKIM pass
+// only counts if the message is signed by the sender's domain.
+func inboundSenderAuthenticated(sender, messageHeaders string) bool {
+	headers := [][]string{}
+	if err := json.Unmarshal([]byte(messageHeaders), &headers); err != nil {
+		return false
+	}
+	at := strings.LastIndex(sender, "@")
+	if at < 0 || at == len(sender)-1 {
+		return false
+	}
+	domain := sender[at+1:]
+
+	// Mailgun adds its headers above the message's own, so only the first
+	// of each counts. Later ones could have been written by the sender.
+	results := map[string]string{}
+	signedBySender := false
+	for _, h := range headers {
+		if len(h) != 2 {
+			continue
+		}
+		name := strings.ToLower(h[0])
+		switch name {
+		case "x-mailgun-spf", "x-mailgun-dkim-check-result":
+			if _, ok := results[name]; !ok {
+				results[name] = strings.ToLower(strings.TrimSpace(h[1]))
+			}
+		case "dkim-signature":
+			if strings.EqualFold(dkimTag(h[1], "d"), domain) {
+				signedBySender = true
+			}
+		}
+	}
+	return results["x-mailgun-spf"] == "pass" ||
+		(results["x-mailgun-dkim-check-result"] == "pass" && signedBySender)
+}
+
+// dkimTag returns the value of a tag in a DKIM-Signature header.
+func dkimTag(header, tag string) string {
+	for _, part := range strings.Split(header, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == tag {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
+
+var (
+	readingDurationPart = regexp.MustCompile(`(?i)^(\d+)\s*(hours|hour|hrs|hr|h|minutes|minute|mins|min|m)([^a-z]|$)`)
+	readingVerb         = regexp.MustCompile(`(?i)^(i\s+)?(read|reading)\b\s*(for\s+)?`)
+)
+
+// parseReadingLog understands lines like "read 25 min", "45m Dune" or
+// "1h 20m". It returns the duration and whatever text followed it, e.g. a
+// book title.
+func parseReadingLog(line string) (time.Duration, string, bool) {
+	rest := strings.TrimSpace(line)
+	rest = strings.TrimSpace(readingVerb.ReplaceAllString(rest, ""))
+
+	duration := time.Duration(0)
+	for {
+		m := readingDurationPart.FindStringSubmatch(rest)
+		if m == nil {
+			break
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return 0, "", false
+		}
+		if strings.HasPrefix(strings.ToLower(m[2]), "h") {
+			duration += time.Duration(n) * time.Hour
+		} else {
+			duration += time.Duration(n) * time.Minute
+		}
+		rest = strings.TrimSpace(rest[len(m[0])-len(m[3]):])
+	}
+	if duration <= 0 || duration > inboundMaxDuration {
+		return 0, "", false
+	}
+	title := strings.TrimSpace(strings.TrimLeft(strings.TrimPrefix(strings.TrimSpace(rest), "of "), "-:,"))
+	return duration, title, true
+}
+
+// findReadingLog returns the first line of text that parses as a reading
+// log, falling back to the subject.
+func findReadingLog(text, subject string) (time.Duration, string, bool) {
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if d, title, ok := parseReadingLog(line); ok {
+			return d, title, ok
+		}
+	}
+	subject = strings.TrimSpace(subject)
+	for _, prefix := range []string{"Re:", "RE:", "Fwd:"} {
+		subject = strings.TrimSpace(strings.TrimPrefix(subject, prefix))
+	}
+	return parseReadingLog(subject)
+}
+
+// HandleMailgunInbound logs a reading session from an email sent by a known
+// user and replies with a confirmation. Mail that fails SPF and DKIM, or that
+// comes from an unknown address, is accepted and dropped so Mailgun doesn't
+// retry it. Mailgun only verifies that it forwarded the message, so without
+// the SPF and DKIM check anyone could log sessions for any user.
+func (api *API) HandleMailgunInbound(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, inboundMaxSize)
+	email, err := api.parseInboundEmail(r)
+	if err != nil {
+		if err == errInboundSignature {
+			// Mailgun stops retrying on 406.
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !email.Authenticated {
+		log.Printf("Dropping inbound email from unauthenticated sender %s", email.Sender)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	tx, err := api.db.Begin()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Each signed token is only processed once, so a replayed request
+	// can't log the same session twice. The token is only kept if the
+	// rest of the transaction commits, so Mailgun can retry failures.
+	result, err := tx.Exec("INSERT INTO inbound_emails (token, sender) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		email.Token, email.Sender)
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	userID := ""
+	userEmail := ""
+	err = tx.QueryRow(`SELECT id, email FROM users
+		WHERE lower(email) = lower($1) AND email_verified_at IS NOT NULL AND disabled_at IS NULL`,
+		email.Sender).Scan(&userID, &userEmail)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			tx.Rollback()
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		tx.Rollback()
+		log.Printf("Dropping inbound email from unknown sender %s", email.Sender)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	duration, title, ok := findReadingLog(email.Text, email.Subject)
+	if ok {
+		_, err = tx.Exec("INSERT INTO reading_sessions (user_id, timestamp, duration) VALUES ($1, $2, $3)",
+			userID, time.Now().Unix(), int(duration/time.Second))
+		if err != nil {
+			tx.Rollback()
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, err = api.sendMailTx(tx, userEmail, emailReadingLogged, ReadingLoggedEmail{
+			Minutes: int(duration / time.Minute),
+			Title:   title,
+			AppURL:  api.baseURL + "/app",
+		})
+	} else {
+		_, err = api.sendMailTx(tx, userEmail, emailReadingNotUnderstood, ReadingNotUnderstoodEmail{})
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Println("error queueing email", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	api.wakeOutbox()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) sweepInboundEmails() error {
+	_, err := api.db.Exec("DELETE FROM inbound_emails WHERE created_at < now() - $1::interval",
+		fmtInterval(inboundTokenMaxAge))
+	return err
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseReadingLog(t *testing.T) {
+	cases := []struct {
+		line     string
+		duration time.Duration
+		title    string
+		ok       bool
+	}{
+		{"read 25 min", 25 * time.Minute, "", true},
+		{"45m Dune", 45 * time.Minute, "Dune", true},
+		{"1h 20m", 80 * time.Minute, "", true},
+		{"I read for 2 hours of The Hobbit", 2 * time.Hour, "The Hobbit", true},
+		{"Reading 30 minutes - Middlemarch", 30 * time.Minute, "Middlemarch", true},
+		{"1h20m", 80 * time.Minute, "", true},
+		{"Dune 45m", 0, "", false},
+		{"read some", 0, "", false},
+		{"0m", 0, "", false},
+		{"13h", 0, "", false},
+		{"", 0, "", false},
+	}
+	for _, c := range cases {
+		duration, title, ok := parseReadingLog(c.line)
+		if ok != c.ok || duration != c.duration || title != c.title {
+			t.Errorf("%q: expected %v %q %v, got %v %q %v", c.line, c.duration, c.title, c.ok, duration, title, ok)
+		}
+	}
+}
+
+func TestFindReadingLog(t *testing.T) {
+	duration, title, ok := findReadingLog("\nHi!\n45m Dune\n", "")
+	if !ok || duration != 45*time.Minute || title != "Dune" {
+		t.Errorf("expected the first parseable line, got %v %q %v", duration, title, ok)
+	}
+	duration, _, ok = findReadingLog("", "Re: read 25 min")
+	if !ok || duration != 25*time.Minute {
+		t.Errorf("expected the subject to be used, got %v %v", duration, ok)
+	}
+}
+
+func signedInboundForm(key string) url.Values {
+	timestamp := fmt.Sprint(time.Now().Unix())
+	return url.Values{
+		"sender":        {"Reader <reader@example.com>"},
+		"subject":       {"reading"},
+		"body-plain":    {"45m Dune\n\n> quoted reply"},
+		"stripped-text": {"45m Dune"},
+		"timestamp":     {timestamp},
+		"token":         {"token"},
+		"signature":     {signMailgun(key, timestamp, "token")},
+		"message-headers": {`[["X-Mailgun-Spf", "Pass"], ["X-Mailgun-Dkim-Check-Result", "Pass"],
+			["DKIM-Signature", "v=1; a=rsa-sha256; d=example.com; s=mail"], ["Subject", "reading"]]`},
+	}
+}
+
+func postInbound(api *API, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/inbound/mailgun", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	api.HandleMailgunInbound(w, r)
+	return w
+}
+
+func TestParseInboundEmail(t *testing.T) {
+	api := &API{mailgunWebhookKey: "key"}
+
+	form := signedInboundForm("key")
+	r := httptest.NewRequest("POST", "/api/inbound/mailgun", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	email, err := api.parseInboundEmail(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email.Sender != "reader@example.com" || email.Text != "45m Dune" || email.Token != "token" || !email.Authenticated {
+		t.Errorf("unexpected email %+v", email)
+	}
+
+	// Routes that keep attachments are posted as multipart.
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for k := range form {
+		mw.WriteField(k, form.Get(k))
+	}
+	mw.Close()
+	r = httptest.NewRequest("POST", "/api/inbound/mailgun", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	email, err = api.parseInboundEmail(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email.Sender != "reader@example.com" || email.Text != "45m Dune" {
+		t.Errorf("unexpected multipart email %+v", email)
+	}
+}
+
+func TestInboundSenderAuthenticated(t *testing.T) {
+	signature := `["DKIM-Signature", "v=1; a=rsa-sha256; d=Example.com; s=mail"]`
+	cases := []struct {
+		name    string
+		sender  string
+		headers string
+		ok      bool
+	}{
+		{"spf pass", "reader@example.com", `[["X-Mailgun-Spf", "Pass"]]`, true},
+		{"dkim pass", "reader@example.com", `[["X-Mailgun-Spf", "SoftFail"], ["X-Mailgun-Dkim-Check-Result", "Pass"], ` + signature + `]`, true},
+		{"dkim pass for another domain", "reader@other.example", `[["X-Mailgun-Dkim-Check-Result", "Pass"], ` + signature + `]`, false},
+		{"both fail", "reader@example.com", `[["X-Mailgun-Spf", "Fail"], ["X-Mailgun-Dkim-Check-Result", "Fail"], ` + signature + `]`, false},
+		// The sender can't override Mailgun's results with its own headers.
+		{"forged result", "reader@example.com", `[["X-Mailgun-Spf", "Fail"], ["Subject", "hi"], ["X-Mailgun-Spf", "Pass"]]`, false},
+		{"no results", "reader@example.com", `[["Subject", "hi"]]`, false},
+		{"no headers", "reader@example.com", ``, false},
+		{"no domain", "reader", `[["X-Mailgun-Spf", "Pass"]]`, false},
+	}
+	for _, c := range cases {
+		if ok := inboundSenderAuthenticated(c.sender, c.headers); ok != c.ok {
+			t.Errorf("%s: expected %v, got %v", c.name, c.ok, ok)
+		}
+	}
+}
+
+func TestHandleMailgunInboundRejectsBadSignature(t *testing.T) {
+	api := &API{mailgunWebhookKey: "key"}
+
+	w := postInbound(api, signedInboundForm("other"))
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("expected %d, got %d", http.StatusNotAcceptable, w.Code)
+	}
+}
+
+func TestHandleMailgunInboundDropsUnauthenticatedSender(t *testing.T) {
+	// Without a database, anything past the SPF and DKIM check would panic.
+	api := &API{mailgunWebhookKey: "key"}
+
+	form := signedInboundForm("key")
+	form.Set("message-headers", `[["X-Mailgun-Spf", "Fail"], ["X-Mailgun-Dkim-Check-Result", "Fail"]]`)
+	w := postInbound(api, form)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func countRows(t *testing.T, db *sql.DB, query string, args ...interface{}) int {
+	t.Helper()
+	n := 0
+	err := db.QueryRow(query, args...).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestHandleMailgunInbound(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	api := &API{db: db, mailgunWebhookKey: "key", baseURL: "https://www.readfaster.app"}
+	userID := createTestUser(t, db, "reader@example.com")
+
+	form := signedInboundForm("key")
+	w := postInbound(api, form)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, w.Code)
+	}
+
+	duration := 0
+	err := db.QueryRow("SELECT duration FROM reading_sessions WHERE user_id = $1", userID).Scan(&duration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration != 45*60 {
+		t.Errorf("expected a duration of %d seconds, got %d", 45*60, duration)
+	}
+	subject := ""
+	err = db.QueryRow("SELECT subject FROM email_outbox WHERE recipient = $1", "reader@example.com").Scan(&subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Logged 45 minutes of reading" {
+		t.Errorf("unexpected confirmation subject %q", subject)
+	}
+
+	// A replayed request is accepted but not processed again.
+	w = postInbound(api, form)
+	if w.Code != http.StatusOK {
+		t.Errorf("replay: expected %d, got %d", http.StatusOK, w.Code)
+	}
+	if n := countRows(t, db, "SELECT count(*) FROM reading_sessions"); n != 1 {
+		t.Errorf("replay: expected 1 reading session, got %d", n)
+	}
+	if n := countRows(t, db, "SELECT count(*) FROM email_outbox"); n != 1 {
+		t.Errorf("replay: expected 1 email, got %d", n)
+	}
+}
+
+func TestHandleMailgunInboundDropsUnknownSender(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	api := &API{db: db, mailgunWebhookKey: "key", baseURL: "https://www.readfaster.app"}
+	createTestUser(t, db, "reader@example.com")
+
+	form := signedInboundForm("key")
+	form.Set("sender", "stranger@example.com")
+	w := postInbound(api, form)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, w.Code)
+	}
+	if n := countRows(t, db, "SELECT count(*) FROM reading_sessions"); n != 0 {
+		t.Errorf("expected no reading sessions, got %d", n)
+	}
+	if n := countRows(t, db, "SELECT count(*) FROM email_outbox"); n != 0 {
+		t.Errorf("expected no emails, got %d", n)
+	}
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"log"
+	"time"
+)
+
+// every runs f in the background every interval until the process exits.
+// Errors are logged and the job keeps running.
+func (api *API) every(name string, interval time.Duration, f func() error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			err := f()
+			if err != nil {
+				log.Printf("job %s: %v", name, err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// sweepExpiredSessions deletes expired auth sessions and login challenges.
+func (api *API) sweepExpiredSessions() error {
+	for _, table := range []string{"auth_sessions", "login_challenges", "webauthn_challenges"} {
+		_, err := api.db.Exec("DELETE FROM " + table + " WHERE expires_at < now()")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeUnverifiedAccounts deletes accounts whose email address was never
+// verified within the configured time.
+func (api *API) purgeUnverifiedAccounts() error {
+	result, err := api.db.Exec("DELETE FROM users WHERE email_verified_at IS NULL AND created_at < now() - $1::interval",
+		fmtInterval(api.unverifiedAccountTTL))
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("Purged %d unverified accounts.", n)
+	}
+	return nil
+}
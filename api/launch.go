@@ -0,0 +1,198 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/badoux/checkmail"
+)
+
+const launchConfirmLinkTTL = 7 * 24 * time.Hour
+
+// HandleLaunchSubscribe adds an unconfirmed launch subscriber and emails
+// them a confirmation link. Subscribers only count once they confirm.
+func (api *API) HandleLaunchSubscribe(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	verify := r.URL.Query().Get("verify")
+	source := r.URL.Query().Get("source")
+	if source == "" {
+		source = "landing"
+	}
+	if len(source) > 64 {
+		source = source[:64]
+	}
+
+	if !api.checkRateLimits(w, rateLimitCheck{subscribeIPLimit, api.clientIP(r)}, rateLimitCheck{subscribeEmailLimit, email}) {
+		return
+	}
+
+	if !api.checkVerify(w, r, verify) {
+		return
+	}
+
+	if err := checkmail.ValidateFormat(email); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Is your email address correct? It doesn't look correct.`))
+		return
+	}
+
+	// Confirmed subscribers are left alone. Anyone else, including people
+	// who unsubscribed before, starts over unconfirmed.
+	err := api.db.QueryRow(`INSERT INTO launch_subscribers (email, source) VALUES ($1, $2)
+		ON CONFLICT (email) DO UPDATE SET subscribed_at = now(), confirmed_at = NULL,
+			unsubscribed_at = NULL, source = EXCLUDED.source
+		WHERE launch_subscribers.confirmed_at IS NULL OR launch_subscribers.unsubscribed_at IS NOT NULL
+		RETURNING email`, email, source).Scan(&email)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`Something went wrong!`))
+		return
+	}
+
+	if err == nil {
+		ts := fmt.Sprint(time.Now().Unix())
+		link := api.origin(r) + "/launch-subscribe/confirm?" + url.Values{
+			"email":  []string{email},
+			"ts":     []string{ts},
+			"verify": []string{api.signature("launch-confirm", ts, email)},
+		}.Encode()
+		err = api.sendMail(email, emailLaunchConfirm, LaunchConfirmEmail{
+			ConfirmURL:     link,
+			UnsubscribeURL: api.launchUnsubscribeLink(email),
+		})
+		if err != nil {
+			log.Println("error queueing email", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`Something went wrong!`))
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/subscribed.html", http.StatusSeeOther)
+}
+
+// launchUnsubscribeLink returns a signed link that unsubscribes email from
+// launch announcements. It doesn't expire.
+func (api *API) launchUnsubscribeLink(email string) string {
+	return api.baseURL + "/launch-subscribe/unsubscribe?" + url.Values{
+		"email":  []string{email},
+		"verify": []string{api.signature("launch-unsubscribe", email)},
+	}.Encode()
+}
+
+var launchSubscriberPage = template.Must(template.New("launch").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{ .Title }} - ReadFaster.app</title><link rel="stylesheet" href="/landing.css"/></head>
+<body>
+<div class="rfa-container">
+<div class="rfa-landing-section">
+<h2>{{ .Title }}</h2>
+<p>{{ .Text }}</p>
+{{- if .Button }}
+<form method="POST">
+<input type="hidden" name="email" value="{{ .Email }}"/>
+{{- if .Ts }}
+<input type="hidden" name="ts" value="{{ .Ts }}"/>
+{{- end }}
+<input type="hidden" name="verify" value="{{ .Verify }}"/>
+<button type="submit">{{ .Button }}</button>
+</form>
+{{- else }}
+<p><a href="/">&larr;Go back</a></p>
+{{- end }}
+</div>
+</div>
+</body>
+</html>
+`))
+
+// HandleLaunchSubscribeConfirm confirms a launch subscription. GET requests
+// only render a confirmation form so link scanners can't confirm for people.
+func (api *API) HandleLaunchSubscribeConfirm(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	ts := r.FormValue("ts")
+	verify := r.FormValue("verify")
+
+	if !api.checkSignature(verify, "launch-confirm", ts, email) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Bad verify parameter.`))
+		return
+	}
+	if !checkSignedTimestamp(ts, launchConfirmLinkTTL) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Link expired.`))
+		return
+	}
+
+	if r.Method != "POST" {
+		launchSubscriberPage.Execute(w, map[string]string{
+			"Title":  "Confirm your subscription",
+			"Text":   "We'll email " + email + " once when ReadFaster launches.",
+			"Button": "Confirm",
+			"Email":  email,
+			"Ts":     ts,
+			"Verify": verify,
+		})
+		return
+	}
+
+	err := api.db.QueryRow(`UPDATE launch_subscribers SET confirmed_at = COALESCE(confirmed_at, now())
+		WHERE email = $1 AND unsubscribed_at IS NULL RETURNING email`, email).Scan(&email)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`This link is no longer valid.`))
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`Something went wrong.`))
+		return
+	}
+
+	launchSubscriberPage.Execute(w, map[string]string{
+		"Title": "Subscribed!",
+		"Text":  "Thanks for confirming! We’ll let you know as soon as we’re live.",
+	})
+}
+
+// HandleLaunchUnsubscribe handles launch unsubscribe links. Like the other
+// unsubscribe links, GET renders a form and POST, including one-click
+// requests from mail clients, unsubscribes.
+func (api *API) HandleLaunchUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	verify := r.FormValue("verify")
+
+	if !api.checkSignature(verify, "launch-unsubscribe", email) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Bad verify parameter.`))
+		return
+	}
+
+	if r.Method != "POST" {
+		launchSubscriberPage.Execute(w, map[string]string{
+			"Title":  "Unsubscribe from launch news?",
+			"Text":   "We won't email " + email + " about the launch.",
+			"Button": "Unsubscribe",
+			"Email":  email,
+			"Verify": verify,
+		})
+		return
+	}
+
+	_, err := api.db.Exec("UPDATE launch_subscribers SET unsubscribed_at = COALESCE(unsubscribed_at, now()) WHERE email = $1", email)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`Something went wrong.`))
+		return
+	}
+	w.Write([]byte(`You've been unsubscribed.`))
+}
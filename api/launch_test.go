@@ -0,0 +1,41 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleLaunchSubscribeConfirmLinks(t *testing.T) {
+	api := &API{authSecret: "secret"}
+	link := func(email string, ts time.Time) string {
+		tsStr := fmt.Sprint(ts.Unix())
+		return "/launch-subscribe/confirm?" + url.Values{
+			"email":  []string{email},
+			"ts":     []string{tsStr},
+			"verify": []string{api.signature("launch-confirm", tsStr, email)},
+		}.Encode()
+	}
+
+	w := httptest.NewRecorder()
+	api.HandleLaunchSubscribeConfirm(w, httptest.NewRequest("GET", link("a@example.com", time.Now()), nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<form") {
+		t.Errorf("expected a confirmation form, got %d %q", w.Code, w.Body.String())
+	}
+
+	cases := []string{
+		link("a@example.com", time.Now().Add(-launchConfirmLinkTTL-time.Hour)),
+		strings.Replace(link("a@example.com", time.Now()), "a%40example.com", "b%40example.com", 1),
+	}
+	for _, c := range cases {
+		w = httptest.NewRecorder()
+		api.HandleLaunchSubscribeConfirm(w, httptest.NewRequest("POST", c, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", c, w.Code)
+		}
+	}
+}
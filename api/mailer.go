@@ -0,0 +1,268 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/mailgun/mailgun-go/v4"
+)
+
+// A Message is a fully rendered email.
+type Message struct {
+	From    string
+	ReplyTo string
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	Headers map[string]string
+}
+
+// A Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// MailerOptions configures NewMailer.
+type MailerOptions struct {
+	// Kind is "mailgun", "smtp", "file" or "log".
+	Kind string
+
+	MailgunDomain string
+	MailgunKey    string
+
+	// SMTPAddr is a host:port. STARTTLS is used if the server supports it.
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+
+	// Dir is where the file mailer writes .eml files.
+	Dir string
+}
+
+func NewMailer(opts MailerOptions) (Mailer, error) {
+	switch opts.Kind {
+	case "mailgun":
+		return &mailgunMailer{mg: mailgun.NewMailgun(opts.MailgunDomain, opts.MailgunKey)}, nil
+	case "smtp":
+		if opts.SMTPAddr == "" {
+			return nil, fmt.Errorf("smtp mailer needs an address")
+		}
+		return &smtpMailer{addr: opts.SMTPAddr, username: opts.SMTPUsername, password: opts.SMTPPassword}, nil
+	case "file":
+		err := os.MkdirAll(opts.Dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+		return &fileMailer{dir: opts.Dir}, nil
+	case "log":
+		return logMailer{}, nil
+	}
+	return nil, fmt.Errorf("unknown mailer %q", opts.Kind)
+}
+
+type mailgunMailer struct {
+	mg mailgun.Mailgun
+}
+
+func (m *mailgunMailer) Send(ctx context.Context, msg *Message) error {
+	mgMsg := m.mg.NewMessage(msg.From, msg.Subject, msg.Text, msg.To)
+	if msg.ReplyTo != "" {
+		mgMsg.SetReplyTo(msg.ReplyTo)
+	}
+	if msg.HTML != "" {
+		mgMsg.SetHtml(msg.HTML)
+	}
+	for k, v := range msg.Headers {
+		mgMsg.AddHeader(k, v)
+	}
+	_, _, err := m.mg.Send(ctx, mgMsg)
+	return err
+}
+
+type smtpMailer struct {
+	addr     string
+	username string
+	password string
+}
+
+func (m *smtpMailer) Send(ctx context.Context, msg *Message) error {
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+	data, err := buildMIME(msg)
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(m.addr)
+	if err != nil {
+		return err
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if m.username != "" {
+		err = c.Auth(smtp.PlainAuth("", m.username, m.password, host))
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(from.Address)
+	if err != nil {
+		return err
+	}
+	err = c.Rcpt(to.Address)
+	if err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// fileMailer writes each message to an .eml file, for local development and
+// tests.
+type fileMailer struct {
+	dir string
+}
+
+func (m *fileMailer) Send(ctx context.Context, msg *Message) error {
+	data, err := buildMIME(msg)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 4)
+	_, err = rand.Read(b)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%x.eml", time.Now().UTC().Format("20060102T150405"), b)
+	return ioutil.WriteFile(filepath.Join(m.dir, name), data, 0644)
+}
+
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, msg *Message) error {
+	log.Println("Email")
+	log.Println("===")
+	log.Println("To:", msg.To)
+	log.Println("Subject:", msg.Subject)
+	for k, v := range msg.Headers {
+		log.Printf("%s: %s", k, v)
+	}
+	log.Println("Content:", msg.Text)
+	if msg.HTML != "" {
+		log.Println("HTML Content:", msg.HTML)
+	}
+	return nil
+}
+
+// buildMIME renders msg as an RFC 5322 message with text and HTML parts.
+func buildMIME(msg *Message) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+
+	headers := map[string]string{
+		"From":         msg.From,
+		"To":           msg.To,
+		"Subject":      mime.QEncoding.Encode("utf-8", msg.Subject),
+		"Date":         time.Now().Format(time.RFC1123Z),
+		"MIME-Version": "1.0",
+		"Content-Type": `multipart/alternative; boundary="` + mw.Boundary() + `"`,
+	}
+	if msg.ReplyTo != "" {
+		headers["Reply-To"] = msg.ReplyTo
+	}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	keys := []string{}
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(buf, "%s: %s\r\n", k, headers[k])
+	}
+	buf.WriteString("\r\n")
+
+	parts := []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	}
+	for _, part := range parts {
+		if part.body == "" {
+			continue
+		}
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              []string{part.contentType},
+			"Content-Transfer-Encoding": []string{"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		_, err = qw.Write([]byte(part.body))
+		if err != nil {
+			return nil, err
+		}
+		err = qw.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := mw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
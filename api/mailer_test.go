@@ -0,0 +1,141 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+type smtpDelivery struct {
+	from, to string
+	data     string
+}
+
+// fakeSMTPServer accepts a single plain-text SMTP session and sends what it
+// received on the returned channel.
+func fakeSMTPServer(t *testing.T) (string, <-chan smtpDelivery) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan smtpDelivery, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+		d := smtpDelivery{}
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			cmd := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL FROM:"):
+				d.from = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+				reply("250 OK")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				d.to = strings.Trim(line[len("RCPT TO:"):], "<> ")
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 Go ahead")
+				data := &strings.Builder{}
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(l, "."))
+				}
+				d.data = data.String()
+				reply("250 OK")
+			case cmd == "QUIT":
+				reply("221 Bye")
+				ch <- d
+				return
+			default:
+				reply("502 Not implemented")
+			}
+		}
+	}()
+	return l.Addr().String(), ch
+}
+
+func TestSMTPMailer(t *testing.T) {
+	addr, ch := fakeSMTPServer(t)
+	m, err := NewMailer(MailerOptions{Kind: "smtp", SMTPAddr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Send(context.Background(), &Message{
+		From:    "ReadFaster <noreply@example.com>",
+		ReplyTo: "Support <support@example.com>",
+		To:      "reader@example.com",
+		Subject: "Welcome to ReadFaster!",
+		Text:    "Hello there.",
+		HTML:    "<p>Hello there.</p>",
+		Headers: map[string]string{"List-Unsubscribe": "<https://example.com/u>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := <-ch
+	if d.from != "noreply@example.com" || d.to != "reader@example.com" {
+		t.Errorf("unexpected envelope %q -> %q", d.from, d.to)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(d.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if subject != "Welcome to ReadFaster!" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	if msg.Header.Get("Reply-To") != "Support <support@example.com>" {
+		t.Errorf("unexpected reply-to %q", msg.Header.Get("Reply-To"))
+	}
+	if msg.Header.Get("List-Unsubscribe") != "<https://example.com/u>" {
+		t.Errorf("missing extra header")
+	}
+
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := map[string]string{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		b, _ := ioutil.ReadAll(p)
+		bodies[strings.SplitN(p.Header.Get("Content-Type"), ";", 2)[0]] = string(b)
+	}
+	if bodies["text/plain"] != "Hello there." {
+		t.Errorf("unexpected text part %q", bodies["text/plain"])
+	}
+	if bodies["text/html"] != "<p>Hello there.</p>" {
+		t.Errorf("unexpected html part %q", bodies["text/html"])
+	}
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// renderMarkdown converts the small subset of Markdown used for
+// announcements into HTML: #, ## and ### headings, paragraphs, "-" or "*"
+// bullet lists, numbered lists, **bold**, *italic* or _italic_, `code` and
+// [links](https://...). Everything else is escaped and shown as text.
+func renderMarkdown(src string) string {
+	out := &strings.Builder{}
+	paragraph := []string{}
+	list := ""
+
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + renderInline(strings.Join(paragraph, " ")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			out.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	openList := func(tag string) {
+		if list != tag {
+			closeList()
+			out.WriteString("<" + tag + ">\n")
+			list = tag
+		}
+	}
+
+	for _, line := range strings.Split(strings.Replace(src, "\r\n", "\n", -1), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			flushParagraph()
+			closeList()
+		case strings.HasPrefix(trimmed, "#"):
+			level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+			text := strings.TrimSpace(trimmed[level:])
+			if level > 3 || !strings.HasPrefix(trimmed[level:], " ") {
+				paragraph = append(paragraph, trimmed)
+				continue
+			}
+			flushParagraph()
+			closeList()
+			tag := "h" + string(rune('0'+level))
+			out.WriteString("<" + tag + ">" + renderInline(text) + "</" + tag + ">\n")
+		case strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* "):
+			flushParagraph()
+			openList("ul")
+			out.WriteString("<li>" + renderInline(strings.TrimSpace(trimmed[2:])) + "</li>\n")
+		case orderedItem.MatchString(trimmed):
+			flushParagraph()
+			openList("ol")
+			text := orderedItem.ReplaceAllString(trimmed, "")
+			out.WriteString("<li>" + renderInline(strings.TrimSpace(text)) + "</li>\n")
+		default:
+			if list != "" {
+				closeList()
+			}
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	flushParagraph()
+	closeList()
+	return out.String()
+}
+
+var (
+	orderedItem  = regexp.MustCompile(`^[0-9]+\. `)
+	inlineCode   = regexp.MustCompile("`([^`]+)`")
+	inlineLink   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	inlineBold   = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	inlineItalic = regexp.MustCompile(`(^|[^*\w])[*_]([^*_]+)[*_]`)
+)
+
+// renderInline escapes text and then applies inline formatting. Code spans
+// and link targets are swapped for placeholders while the rest is
+// formatted, so underscores and asterisks in them are left alone.
+func renderInline(text string) string {
+	text = html.EscapeString(strings.Replace(text, "\x00", "", -1))
+
+	stashed := []string{}
+	stash := func(s string) string {
+		stashed = append(stashed, s)
+		return "\x00" + strconv.Itoa(len(stashed)-1) + "\x00"
+	}
+
+	text = inlineCode.ReplaceAllStringFunc(text, func(m string) string {
+		return stash("<code>" + inlineCode.FindStringSubmatch(m)[1] + "</code>")
+	})
+	text = inlineLink.ReplaceAllStringFunc(text, func(m string) string {
+		parts := inlineLink.FindStringSubmatch(m)
+		href := html.UnescapeString(parts[2])
+		if !strings.HasPrefix(href, "https://") && !strings.HasPrefix(href, "http://") && !strings.HasPrefix(href, "mailto:") {
+			return m
+		}
+		return stash(`<a href="`+html.EscapeString(href)+`">`) + parts[1] + stash("</a>")
+	})
+	text = inlineBold.ReplaceAllString(text, "<strong>$1</strong>")
+	text = inlineItalic.ReplaceAllString(text, "$1<em>$2</em>")
+
+	for i, s := range stashed {
+		text = strings.Replace(text, "\x00"+strconv.Itoa(i)+"\x00", s, 1)
+	}
+	return text
+}
@@ -0,0 +1,26 @@
+package api
+
+import "testing"
+
+func TestRenderMarkdown(t *testing.T) {
+	cases := []struct {
+		src, html string
+	}{
+		{"Hello **world**", "<p>Hello <strong>world</strong></p>\n"},
+		{"one\ntwo\n\nthree", "<p>one two</p>\n<p>three</p>\n"},
+		{"# Title\n## Sub", "<h1>Title</h1>\n<h2>Sub</h2>\n"},
+		{"#hashtag", "<p>#hashtag</p>\n"},
+		{"- a\n- *b*\n\n1. x\n2. y", "<ul>\n<li>a</li>\n<li><em>b</em></li>\n</ul>\n<ol>\n<li>x</li>\n<li>y</li>\n</ol>\n"},
+		{"intro\n- a\nafter", "<p>intro</p>\n<ul>\n<li>a</li>\n</ul>\n<p>after</p>\n"},
+		{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"[site](https://example.com/a_b_c)", `<p><a href="https://example.com/a_b_c">site</a></p>` + "\n"},
+		{"[bad](javascript:alert(1))", "<p>[bad](javascript:alert(1))</p>\n"},
+		{"use `**raw**` and snake_case_name", "<p>use <code>**raw**</code> and snake_case_name</p>\n"},
+		{`[x](https://e.com/"onmouseover=")`, `<p><a href="https://e.com/&#34;onmouseover=&#34;">x</a></p>` + "\n"},
+	}
+	for _, c := range cases {
+		if got := renderMarkdown(c.src); got != c.html {
+			t.Errorf("%q:\nexpected %q\ngot      %q", c.src, c.html, got)
+		}
+	}
+}
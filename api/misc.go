@@ -1,13 +1,48 @@
 package api
 
 import (
+	"net"
 	"net/http"
+	"strings"
 )
 
-func getIP(r *http.Request) string {
-	forwarded := r.Header.Get("X-Forwarded-For")
-	if forwarded != "" {
-		return forwarded
+// clientIP returns the address of the client that made the request,
+// without a port. Each trusted proxy in front of the app appends the address
+// it got the request from to X-Forwarded-For, so the client is that many
+// hops from the right. Anything further left is up to the client.
+func clientIP(r *http.Request, trustedProxies int) string {
+	hops := []string{}
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
 	}
-	return r.RemoteAddr
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	hops = append(hops, host)
+
+	// Requests that didn't pass through every proxy have fewer hops, all
+	// of them added by proxies we trust.
+	i := len(hops) - 1 - trustedProxies
+	if i < 0 {
+		i = 0
+	}
+	return hops[i]
+}
+
+func (api *API) clientIP(r *http.Request) string {
+	return clientIP(r, api.trustedProxies)
+}
+
+// origin returns the scheme and host the app is served from. In dev mode
+// it's taken from the request.
+func (api *API) origin(r *http.Request) string {
+	if api.devMode {
+		return "http://" + r.Host
+	}
+	return api.baseURL
 }
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	cases := []struct {
+		name           string
+		forwardedFor   []string
+		trustedProxies int
+		expected       string
+	}{
+		{"no proxies", nil, 0, "127.0.0.1"},
+		{"header ignored without proxies", []string{"203.0.113.9"}, 0, "127.0.0.1"},
+		{"one proxy", []string{"198.51.100.7"}, 1, "198.51.100.7"},
+		// The client sent its own X-Forwarded-For, which the proxy appended to.
+		{"spoofed hop", []string{"203.0.113.9, 198.51.100.7"}, 1, "198.51.100.7"},
+		{"spoofed header line", []string{"203.0.113.9", "198.51.100.7"}, 1, "198.51.100.7"},
+		{"two proxies", []string{"203.0.113.9, 198.51.100.7, 192.0.2.1"}, 2, "198.51.100.7"},
+		{"skipped the proxy", nil, 1, "127.0.0.1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/api/user", nil)
+		r.RemoteAddr = "127.0.0.1:54321"
+		for _, v := range c.forwardedFor {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if ip := clientIP(r, c.trustedProxies); ip != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, ip)
+		}
+	}
+}
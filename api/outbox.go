@@ -0,0 +1,295 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	outboxBatchSize   = 20
+	outboxMaxAttempts = 8
+	outboxPoll        = 10 * time.Second
+	outboxSendTimeout = 30 * time.Second
+	// outboxLease is how long a claimed batch is hidden from other workers.
+	// Its messages are sent one after another, so it must outlast sending
+	// all of them, or another worker could claim and send some again.
+	outboxLease      = outboxBatchSize*outboxSendTimeout + time.Minute
+	outboxBaseDelay  = 30 * time.Second
+	outboxMaxDelay   = 6 * time.Hour
+	outboxSentMaxAge = 30 * 24 * time.Hour
+)
+
+// execer is satisfied by both *sql.DB and *sql.Tx, so messages can be queued
+// in the same transaction as the change that triggers them.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// enqueueMail stores msg in the outbox and returns its ID. It is sent by the
+// outbox worker once the surrounding transaction commits. A message with a
+// ttl is given up on once it's that old, and its body is scrubbed after it's
+// sent.
+func enqueueMail(q execer, msg *Message, ttl time.Duration) (int64, error) {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return 0, err
+	}
+	// A NULL interval leaves expires_at NULL.
+	var expiresIn *string
+	if ttl > 0 {
+		interval := fmtInterval(ttl)
+		expiresIn = &interval
+	}
+	id := int64(0)
+	err = q.QueryRow(`INSERT INTO email_outbox (recipient, subject, text_body, html_body, headers, expires_at)
+		VALUES ($1, $2, $3, $4, $5, now() + $6::interval) RETURNING id`,
+		msg.To, msg.Subject, msg.Text, msg.HTML, string(headers), expiresIn).Scan(&id)
+	return id, err
+}
+
+// wakeOutbox makes the worker check for messages now instead of waiting for
+// the next poll.
+func (api *API) wakeOutbox() {
+	select {
+	case api.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// outboxBackoff returns how long to wait before the next attempt after
+// attempts failed deliveries.
+func outboxBackoff(attempts int) time.Duration {
+	delay := outboxBaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= outboxMaxDelay {
+			return outboxMaxDelay
+		}
+	}
+	return delay
+}
+
+// runOutboxWorker delivers queued messages in the background until the
+// process exits.
+func (api *API) runOutboxWorker() {
+	go func() {
+		ticker := time.NewTicker(outboxPoll)
+		defer ticker.Stop()
+		for {
+			for {
+				n, err := api.deliverOutbox()
+				if err != nil {
+					log.Printf("job deliver-email: %v", err)
+				}
+				if err != nil || n < outboxBatchSize {
+					break
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-api.outboxWake:
+			}
+		}
+	}()
+}
+
+type outboxMessage struct {
+	id       int64
+	attempts int
+	msg      Message
+}
+
+// deliverOutbox claims a batch of due messages and tries to send them. It
+// returns the number of messages claimed.
+func (api *API) deliverOutbox() (int, error) {
+	err := api.expireOutbox()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := api.db.Query(`UPDATE email_outbox SET next_attempt_at = now() + $2::interval
+		WHERE id IN (SELECT id FROM email_outbox
+			WHERE status = 'pending' AND next_attempt_at <= now()
+			ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED)
+		RETURNING id, attempts, recipient, subject, text_body, html_body, headers`,
+		outboxBatchSize, fmtInterval(outboxLease))
+	if err != nil {
+		return 0, err
+	}
+	batch := []outboxMessage{}
+	for rows.Next() {
+		m := outboxMessage{}
+		headers := ""
+		err = rows.Scan(&m.id, &m.attempts, &m.msg.To, &m.msg.Subject, &m.msg.Text, &m.msg.HTML, &headers)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		err = json.Unmarshal([]byte(headers), &m.msg.Headers)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, m)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, m := range batch {
+		m.msg.From = api.mailFrom
+		m.msg.ReplyTo = api.mailReplyTo
+
+		ctx, cancel := context.WithTimeout(context.Background(), outboxSendTimeout)
+		sendErr := api.mailer.Send(ctx, &m.msg)
+		cancel()
+
+		if sendErr == nil {
+			_, err = api.db.Exec(`UPDATE email_outbox SET status = 'sent', sent_at = now(),
+				attempts = attempts + 1, last_error = '',
+				text_body = CASE WHEN expires_at IS NULL THEN text_body ELSE '' END,
+				html_body = CASE WHEN expires_at IS NULL THEN html_body ELSE '' END
+				WHERE id = $1`, m.id)
+		} else if m.attempts+1 >= outboxMaxAttempts {
+			log.Printf("email %d to %s failed permanently: %v", m.id, m.msg.To, sendErr)
+			_, err = api.db.Exec(`UPDATE email_outbox SET status = 'dead',
+				attempts = attempts + 1, last_error = $2 WHERE id = $1`, m.id, sendErr.Error())
+		} else {
+			log.Printf("email %d to %s failed: %v", m.id, m.msg.To, sendErr)
+			_, err = api.db.Exec(`UPDATE email_outbox SET next_attempt_at = now() + $2::interval,
+				attempts = attempts + 1, last_error = $3 WHERE id = $1`,
+				m.id, fmtInterval(outboxBackoff(m.attempts+1)), sendErr.Error())
+		}
+		if err != nil {
+			return len(batch), err
+		}
+	}
+	return len(batch), nil
+}
+
+// expireOutbox gives up on time-sensitive messages whose links no longer
+// work and scrubs their bodies, including dead ones that an admin can no
+// longer usefully retry.
+func (api *API) expireOutbox() error {
+	_, err := api.db.Exec(`UPDATE email_outbox SET status = 'dead', text_body = '', html_body = '',
+			last_error = CASE WHEN status = 'pending' THEN 'expired' ELSE last_error END
+		WHERE expires_at <= now() AND (status = 'pending' OR (status = 'dead' AND text_body <> ''))`)
+	return err
+}
+
+// sweepEmailOutbox deletes delivered messages after a while. Dead messages
+// are kept until an admin retries or deletes them.
+func (api *API) sweepEmailOutbox() error {
+	_, err := api.db.Exec("DELETE FROM email_outbox WHERE status = 'sent' AND sent_at < now() - $1::interval",
+		fmtInterval(outboxSentMaxAge))
+	return err
+}
+
+type OutboxMessage struct {
+	ID            int64  `json:"id"`
+	Recipient     string `json:"recipient"`
+	Subject       string `json:"subject"`
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	LastError     string `json:"last_error"`
+	CreatedAt     int64  `json:"created_at"`
+	NextAttemptAt int64  `json:"next_attempt_at"`
+	SentAt        *int64 `json:"sent_at"`
+}
+
+func (api *API) HandleAPIAdminGetEmailOutbox(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	counts := map[string]int{"pending": 0, "sent": 0, "dead": 0}
+	rows, err := api.db.Query("SELECT status, count(*) FROM email_outbox GROUP BY status")
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s := ""
+		n := 0
+		err = rows.Scan(&s, &n)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		counts[s] = n
+	}
+
+	rows, err = api.db.Query(`SELECT id, recipient, subject, status, attempts, last_error,
+			extract(epoch from created_at)::BIGINT, extract(epoch from next_attempt_at)::BIGINT,
+			extract(epoch from sent_at)::BIGINT
+		FROM email_outbox WHERE $1 = '' OR status = $1
+		ORDER BY id DESC LIMIT $2`, status, limit)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	messages := []OutboxMessage{}
+	for rows.Next() {
+		m := OutboxMessage{}
+		err = rows.Scan(&m.ID, &m.Recipient, &m.Subject, &m.Status, &m.Attempts, &m.LastError,
+			&m.CreatedAt, &m.NextAttemptAt, &m.SentAt)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		messages = append(messages, m)
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"counts":   counts,
+		"messages": messages,
+	})
+}
+
+// HandleAPIAdminPostRetryEmail puts a dead message back in the queue.
+// Time-sensitive messages can only be retried while their links still work.
+func (api *API) HandleAPIAdminPostRetryEmail(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["message_id"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	result, err := api.db.Exec(`UPDATE email_outbox SET status = 'pending', attempts = 0, next_attempt_at = now()
+		WHERE id = $1 AND status = 'dead' AND (expires_at IS NULL OR expires_at > now())`, id)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	api.wakeOutbox()
+	w.WriteHeader(http.StatusNoContent)
+}
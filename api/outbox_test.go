@@ -0,0 +1,35 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	cases := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{20, outboxMaxDelay},
+	}
+	for _, c := range cases {
+		if got := outboxBackoff(c.attempts); got != c.delay {
+			t.Errorf("attempts %d: expected %v, got %v", c.attempts, c.delay, got)
+		}
+	}
+}
+
+func TestEmailLinkTTLs(t *testing.T) {
+	for name, ttl := range emailLinkTTLs {
+		if _, ok := emailKinds[name]; !ok {
+			t.Errorf("%s: not a registered email", name)
+		}
+		if ttl <= 0 {
+			t.Errorf("%s: expected a positive TTL, got %v", name, ttl)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores everything after 72 bytes.
+	maxPasswordLength = 72
+)
+
+// A PasswordError is a single password policy violation.
+type PasswordError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// validatePassword checks password against the password policy and returns
+// every violation. breachedDir may be empty to skip the breached password
+// check.
+func validatePassword(password, email, breachedDir string) ([]PasswordError, error) {
+	errs := []PasswordError{}
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		errs = append(errs, PasswordError{"too_short",
+			fmt.Sprintf("Passwords must be at least %d characters long.", minPasswordLength)})
+	}
+	if len(password) > maxPasswordLength {
+		errs = append(errs, PasswordError{"too_long",
+			fmt.Sprintf("Passwords can be at most %d bytes long.", maxPasswordLength)})
+	}
+	if email != "" && strings.EqualFold(strings.TrimSpace(password), email) {
+		errs = append(errs, PasswordError{"matches_email",
+			"Passwords can't be the same as your email address."})
+	}
+	if len(errs) > 0 || breachedDir == "" {
+		return errs, nil
+	}
+
+	breached, err := isBreachedPassword(breachedDir, password)
+	if err != nil {
+		return nil, err
+	}
+	if breached {
+		errs = append(errs, PasswordError{"breached",
+			"This password has appeared in a data breach. Please choose a different one."})
+	}
+	return errs, nil
+}
+
+// isBreachedPassword looks up password in a local copy of a breached
+// password list stored k-anonymity style, like the Pwned Passwords range
+// API: the upper-case SHA-1 hash is split into a 5 character prefix, which
+// names a file in dir, and a suffix, which is looked up in that file as
+// "SUFFIX:COUNT" lines. Missing range files mean no match.
+func isBreachedPassword(dir, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(dir, prefix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if colon := strings.IndexByte(line, ':'); colon >= 0 {
+			line = line[:colon]
+		}
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidatePassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "breached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// SHA-1("password1") = E38AD214943DAAD1D64C102FAEC29DE4AFE9DA3D
+	err = ioutil.WriteFile(filepath.Join(dir, "E38AD"),
+		[]byte("0000000000000000000000000000000000A:1\r\n214943DAAD1D64C102FAEC29DE4AFE9DA3D:2413945\r\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		password string
+		codes    []string
+	}{
+		{"correct horse battery staple", nil},
+		{"short", []string{"too_short"}},
+		{strings.Repeat("a", 73), []string{"too_long"}},
+		{"Reader@Example.com", []string{"matches_email"}},
+		{"password1", []string{"breached"}},
+	}
+	for _, c := range cases {
+		errs, err := validatePassword(c.password, "reader@example.com", dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes := []string{}
+		for _, e := range errs {
+			codes = append(codes, e.Code)
+		}
+		if strings.Join(codes, ",") != strings.Join(c.codes, ",") {
+			t.Errorf("%q: expected %v, got %v", c.password, c.codes, codes)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// Email categories users can opt out of. Each one is a column in
+// email_preferences.
+const (
+	emailCategoryDigest        = "digest"
+	emailCategoryReminders     = "reminders"
+	emailCategoryAnnouncements = "announcements"
+)
+
+var emailCategories = []string{emailCategoryDigest, emailCategoryReminders, emailCategoryAnnouncements}
+
+func isEmailCategory(category string) bool {
+	for _, c := range emailCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// emailPreference returns the ID of the user with the email address and
+// whether they get emails in category. Addresses without an account get
+// everything.
+func (api *API) emailPreference(email, category string) (string, bool, error) {
+	if !isEmailCategory(category) {
+		return "", false, nil
+	}
+	userID := ""
+	enabled := true
+	err := api.db.QueryRow(`SELECT u.id, COALESCE(p.`+category+`, true)
+		FROM users u LEFT JOIN email_preferences p ON p.user_id = u.id
+		WHERE u.email = $1`, email).Scan(&userID, &enabled)
+	if err == sql.ErrNoRows {
+		return "", true, nil
+	}
+	return userID, enabled, err
+}
+
+// unsubscribeLink returns a signed link that turns off category for the
+// user. It doesn't expire.
+func (api *API) unsubscribeLink(userID, category string) string {
+	return api.baseURL + "/app/unsubscribe?" + url.Values{
+		"user":     []string{userID},
+		"category": []string{category},
+		"verify":   []string{api.signature("unsubscribe", userID, category)},
+	}.Encode()
+}
+
+func (api *API) setEmailPreference(userID, category string, enabled bool) error {
+	if !isEmailCategory(category) {
+		return nil
+	}
+	_, err := api.db.Exec(`INSERT INTO email_preferences (user_id, `+category+`)
+		SELECT id, $2 FROM users WHERE id = $1
+		ON CONFLICT (user_id) DO UPDATE SET `+category+` = $2, updated_at = now()`, userID, enabled)
+	return err
+}
+
+func (api *API) HandleAPIGetEmailPreferences(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	digest, reminders, announcements := true, true, true
+	err := api.db.QueryRow("SELECT digest, reminders, announcements FROM email_preferences WHERE user_id = $1",
+		userID).Scan(&digest, &reminders, &announcements)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{
+		emailCategoryDigest:        digest,
+		emailCategoryReminders:     reminders,
+		emailCategoryAnnouncements: announcements,
+	})
+}
+
+// HandleAPIPutEmailPreferences updates the categories given in the request
+// body and leaves the others alone.
+func (api *API) HandleAPIPutEmailPreferences(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	requestBody := map[string]bool{}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for category := range requestBody {
+		if !isEmailCategory(category) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`Unknown email category.`))
+			return
+		}
+	}
+
+	for category, enabled := range requestBody {
+		err = api.setEmailPreference(userID, category, enabled)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Unsubscribe - ReadFaster.app</title><link rel="stylesheet" href="/landing.css"/></head>
+<body>
+<div class="rfa-container">
+<div class="rfa-landing-section">
+<h2>Unsubscribe from {{ .Category }} emails?</h2>
+<p>You'll still get emails about your account, like login links.</p>
+<form method="POST">
+<input type="hidden" name="user" value="{{ .User }}"/>
+<input type="hidden" name="category" value="{{ .Category }}"/>
+<input type="hidden" name="verify" value="{{ .Verify }}"/>
+<button type="submit">Unsubscribe</button>
+</form>
+</div>
+</div>
+</body>
+</html>
+`))
+
+// HandleUnsubscribe handles unsubscribe links. GET requests render a
+// confirmation form so link scanners can't unsubscribe people; POST
+// requests, including RFC 8058 one-click requests from mail clients,
+// unsubscribe right away.
+func (api *API) HandleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	userID := r.FormValue("user")
+	category := r.FormValue("category")
+	verify := r.FormValue("verify")
+
+	if !isEmailCategory(category) || !api.checkSignature(verify, "unsubscribe", userID, category) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Bad verify parameter.`))
+		return
+	}
+
+	if r.Method != "POST" {
+		unsubscribePage.Execute(w, map[string]string{
+			"User":     userID,
+			"Category": category,
+			"Verify":   verify,
+		})
+		return
+	}
+
+	err := api.setEmailPreference(userID, category, false)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`Something went wrong.`))
+		return
+	}
+	w.Write([]byte(`You've been unsubscribed.`))
+}
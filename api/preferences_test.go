@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHandleUnsubscribeChecksSignature(t *testing.T) {
+	api := &API{authSecret: "secret", baseURL: "https://rfa.example"}
+	link := api.unsubscribeLink("abc123", emailCategoryDigest)
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	api.HandleUnsubscribe(w, httptest.NewRequest("GET", u.RequestURI(), nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<form") {
+		t.Errorf("expected a confirmation form, got %d %q", w.Code, w.Body.String())
+	}
+
+	for _, tampered := range []string{
+		strings.Replace(u.RequestURI(), "abc123", "abc124", 1),
+		strings.Replace(u.RequestURI(), "category=digest", "category=reminders", 1),
+	} {
+		w = httptest.NewRecorder()
+		api.HandleUnsubscribe(w, httptest.NewRequest("POST", tampered, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", tampered, w.Code)
+		}
+	}
+}
+
+func TestRenderEmailUnsubscribeFooter(t *testing.T) {
+	msg, err := renderEmail("https://rfa.example", "https://rfa.example/app/unsubscribe?x=1", "reader@example.com",
+		emailDigest, emailKinds[emailDigest].sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg.Text, "Unsubscribe: https://rfa.example/app/unsubscribe?x=1") {
+		t.Errorf("missing unsubscribe link in text part:\n%s", msg.Text)
+	}
+	if !strings.Contains(msg.HTML, `href="https://rfa.example/app/unsubscribe?x=1"`) {
+		t.Errorf("missing unsubscribe link in HTML part")
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A rateLimit is a token bucket holding up to burst tokens, refilled at one
+// token every per. Buckets are stored in Postgres so limits hold across
+// instances.
+type rateLimit struct {
+	name  string
+	burst float64
+	per   time.Duration
+}
+
+var (
+	loginIPLimit        = rateLimit{"login-ip", 20, 30 * time.Second}
+	loginEmailLimit     = rateLimit{"login-email", 10, time.Minute}
+	registerIPLimit     = rateLimit{"register-ip", 5, 10 * time.Minute}
+	registerEmailLimit  = rateLimit{"register-email", 3, 20 * time.Minute}
+	subscribeIPLimit    = rateLimit{"subscribe-ip", 5, 10 * time.Minute}
+	subscribeEmailLimit = rateLimit{"subscribe-email", 2, time.Hour}
+	changeEmailLimit    = rateLimit{"change-email", 5, 20 * time.Minute}
+	changeEmailToLimit  = rateLimit{"change-email-to", 2, time.Hour}
+)
+
+const (
+	// Accounts are locked after this many consecutive password failures,
+	// for a minute at first and doubling with every further failure.
+	lockoutThreshold = 5
+	maxLockout       = 24 * time.Hour
+)
+
+// takeToken refills a bucket holding tokens after elapsed and takes a token
+// from it. It returns the new token count and how long to wait if no token
+// was available.
+func (limit rateLimit) takeToken(tokens float64, elapsed time.Duration) (float64, time.Duration) {
+	tokens = math.Min(limit.burst, tokens+elapsed.Seconds()/limit.per.Seconds())
+	if tokens >= 1 {
+		return tokens - 1, 0
+	}
+	return tokens, time.Duration((1 - tokens) * float64(limit.per))
+}
+
+// allow takes a token from the bucket for key and returns how long to wait
+// if none was available.
+func (api *API) allow(limit rateLimit, key string) (time.Duration, error) {
+	bucket := limit.name + ":" + strings.ToLower(key)
+
+	tx, err := api.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("INSERT INTO rate_limits (key, tokens, updated_at) VALUES ($1, $2, now()) ON CONFLICT DO NOTHING",
+		bucket, limit.burst)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	tokens := 0.0
+	elapsed := 0.0
+	err = tx.QueryRow("SELECT tokens, extract(epoch from now() - updated_at) FROM rate_limits WHERE key = $1 FOR UPDATE",
+		bucket).Scan(&tokens, &elapsed)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	tokens, retryAfter := limit.takeToken(tokens, time.Duration(elapsed*float64(time.Second)))
+	_, err = tx.Exec("UPDATE rate_limits SET tokens = $1, updated_at = now() WHERE key = $2", tokens, bucket)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return retryAfter, tx.Commit()
+}
+
+type rateLimitCheck struct {
+	limit rateLimit
+	key   string
+}
+
+// checkRateLimits takes a token from every bucket and writes a 429 response
+// if any of them is empty.
+func (api *API) checkRateLimits(w http.ResponseWriter, checks ...rateLimitCheck) bool {
+	retryAfter := time.Duration(0)
+	for _, check := range checks {
+		wait, err := api.allow(check.limit, check.key)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`Something went wrong!`))
+			return false
+		}
+		if wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		writeTooManyRequests(w, retryAfter)
+		return false
+	}
+	return true
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(`Too many attempts. Please try again later.`))
+}
+
+// recordLoginFailure counts a failed password or code for the user and
+// locks the account once there are too many in a row.
+func (api *API) recordLoginFailure(userID string) error {
+	_, err := api.db.Exec(`UPDATE users SET failed_logins = failed_logins + 1,
+		locked_until = CASE WHEN failed_logins + 1 >= $2
+			THEN now() + LEAST(power(2, failed_logins + 1 - $2) * 60, $3) * interval '1 second'
+			ELSE locked_until END
+		WHERE id = $1`, userID, lockoutThreshold, maxLockout.Seconds())
+	return err
+}
+
+func (api *API) resetLoginFailures(userID string) error {
+	_, err := api.db.Exec("UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = $1 AND failed_logins > 0", userID)
+	return err
+}
+
+func (api *API) sweepRateLimits() error {
+	_, err := api.db.Exec("DELETE FROM rate_limits WHERE updated_at < now() - interval '1 day'")
+	return err
+}
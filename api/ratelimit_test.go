@@ -0,0 +1,39 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitTakeToken(t *testing.T) {
+	limit := rateLimit{"test", 3, 10 * time.Second}
+
+	tokens := limit.burst
+	for i := 0; i < 3; i++ {
+		wait := time.Duration(0)
+		tokens, wait = limit.takeToken(tokens, 0)
+		if wait != 0 {
+			t.Fatalf("request %d: expected to be allowed", i)
+		}
+	}
+
+	tokens, wait := limit.takeToken(tokens, 0)
+	if wait != 10*time.Second {
+		t.Errorf("expected to wait 10s, got %v", wait)
+	}
+
+	tokens, wait = limit.takeToken(tokens, 5*time.Second)
+	if wait != 5*time.Second {
+		t.Errorf("expected to wait 5s, got %v", wait)
+	}
+
+	_, wait = limit.takeToken(tokens, 5*time.Second)
+	if wait != 0 {
+		t.Errorf("expected refilled bucket to allow, got wait %v", wait)
+	}
+
+	tokens, _ = limit.takeToken(0, time.Hour)
+	if tokens != limit.burst-1 {
+		t.Errorf("expected refill to cap at burst, got %v tokens", tokens)
+	}
+}
@@ -0,0 +1,269 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	reminderInterval = 5 * time.Minute
+	// reminderWindow is how long after the chosen time a reminder may still
+	// go out, e.g. after downtime. Later than that it's skipped for the day.
+	reminderWindow = 3 * time.Hour
+)
+
+// A Notification is a reading reminder for one user.
+type Notification struct {
+	UserID string
+	Email  string
+	// StreakDays is the streak that ends today unless the user reads.
+	StreakDays int
+}
+
+// A Notifier delivers notifications through one channel.
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+// emailNotifier sends reminders by email. sendMail drops them for users who
+// opted out of reminder emails.
+type emailNotifier struct {
+	api *API
+}
+
+func (e *emailNotifier) Notify(n *Notification) error {
+	return e.api.sendMail(n.Email, emailReminder, ReminderEmail{
+		StreakDays: n.StreakDays,
+		AppURL:     e.api.baseURL + "/app",
+	})
+}
+
+type reminderSettings struct {
+	Enabled bool
+	// Times are minutes after local midnight. Quiet hours may wrap past
+	// midnight and are unset if start equals end.
+	RemindAt   int
+	QuietStart int
+	QuietEnd   int
+}
+
+func inQuietHours(minute, start, end int) bool {
+	if start == end {
+		return false
+	}
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// reminderDue reports whether a reminder should go out at local time now
+// if the user hasn't read today.
+func reminderDue(local time.Time, s reminderSettings) bool {
+	if !s.Enabled {
+		return false
+	}
+	minute := local.Hour()*60 + local.Minute()
+	if minute < s.RemindAt || minute >= s.RemindAt+int(reminderWindow/time.Minute) {
+		return false
+	}
+	return !inQuietHours(minute, s.QuietStart, s.QuietEnd)
+}
+
+// sendReminders nudges users who haven't read today once their reminder
+// time comes around.
+func (api *API) sendReminders() error {
+	rows, err := api.db.Query(`SELECT u.id, u.email, u.timezone, s.remind_at, s.quiet_start, s.quiet_end,
+			COALESCE(to_char(s.last_sent_on, 'YYYY-MM-DD'), '')
+		FROM reminder_settings s JOIN users u ON u.id = s.user_id
+		LEFT JOIN email_preferences p ON p.user_id = u.id
+		WHERE s.enabled AND u.email_verified_at IS NOT NULL AND u.disabled_at IS NULL
+			AND COALESCE(p.reminders, true)`)
+	if err != nil {
+		return err
+	}
+	type candidate struct {
+		notification Notification
+		timezone     string
+		settings     reminderSettings
+		lastSentOn   string
+	}
+	candidates := []candidate{}
+	for rows.Next() {
+		c := candidate{settings: reminderSettings{Enabled: true}}
+		err = rows.Scan(&c.notification.UserID, &c.notification.Email, &c.timezone,
+			&c.settings.RemindAt, &c.settings.QuietStart, &c.settings.QuietEnd, &c.lastSentOn)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, c := range candidates {
+		loc, err := time.LoadLocation(c.timezone)
+		if err != nil {
+			loc = time.UTC
+		}
+		local := now.In(loc)
+		today := local.Format("2006-01-02")
+		if c.lastSentOn == today || !reminderDue(local, c.settings) {
+			continue
+		}
+
+		midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+		readToday := false
+		err = api.db.QueryRow("SELECT EXISTS (SELECT 1 FROM reading_sessions WHERE user_id = $1 AND timestamp >= $2)",
+			c.notification.UserID, midnight.Unix()).Scan(&readToday)
+		if err != nil {
+			return err
+		}
+		if readToday {
+			continue
+		}
+
+		// Claim today's reminder so other instances skip it.
+		result, err := api.db.Exec(`UPDATE reminder_settings SET last_sent_on = $2
+			WHERE user_id = $1 AND (last_sent_on IS NULL OR last_sent_on < $2)`, c.notification.UserID, today)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			continue
+		}
+
+		c.notification.StreakDays, err = api.streakBefore(c.notification.UserID, midnight)
+		if err != nil {
+			return err
+		}
+		for _, notifier := range api.notifiers {
+			err = notifier.Notify(&c.notification)
+			if err != nil {
+				log.Printf("reminder for %s: %v", c.notification.UserID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// streakBefore counts the consecutive days with reading that end the day
+// before midnight.
+func (api *API) streakBefore(userID string, midnight time.Time) (int, error) {
+	rows, err := api.db.Query("SELECT timestamp, duration FROM reading_sessions WHERE user_id = $1 AND timestamp >= $2 AND timestamp < $3",
+		userID, midnight.AddDate(0, 0, -digestStreakDays).Unix(), midnight.Unix())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	days := map[string]bool{}
+	for rows.Next() {
+		s := ReadingSession{}
+		err = rows.Scan(&s.Timestamp, &s.Duration)
+		if err != nil {
+			return 0, err
+		}
+		days[time.Unix(s.Timestamp, 0).In(midnight.Location()).Format("2006-01-02")] = true
+	}
+	streak := 0
+	for day := midnight.AddDate(0, 0, -1); days[day.Format("2006-01-02")]; day = day.AddDate(0, 0, -1) {
+		streak++
+	}
+	return streak, rows.Err()
+}
+
+func formatMinuteOfDay(minute int) string {
+	return fmt.Sprintf("%02d:%02d", minute/60, minute%60)
+}
+
+func parseMinuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (api *API) HandleAPIGetReminders(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	s := reminderSettings{RemindAt: 20 * 60}
+	err := api.db.QueryRow("SELECT enabled, remind_at, quiet_start, quiet_end FROM reminder_settings WHERE user_id = $1",
+		userID).Scan(&s.Enabled, &s.RemindAt, &s.QuietStart, &s.QuietEnd)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":     s.Enabled,
+		"time":        formatMinuteOfDay(s.RemindAt),
+		"quiet_start": formatMinuteOfDay(s.QuietStart),
+		"quiet_end":   formatMinuteOfDay(s.QuietEnd),
+	})
+}
+
+func (api *API) HandleAPIPutReminders(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	requestBody := struct {
+		Enabled    bool   `json:"enabled"`
+		Time       string `json:"time"`
+		QuietStart string `json:"quiet_start"`
+		QuietEnd   string `json:"quiet_end"`
+	}{QuietStart: "00:00", QuietEnd: "00:00"}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s := reminderSettings{Enabled: requestBody.Enabled}
+	for _, field := range []struct {
+		value string
+		dst   *int
+	}{
+		{requestBody.Time, &s.RemindAt},
+		{requestBody.QuietStart, &s.QuietStart},
+		{requestBody.QuietEnd, &s.QuietEnd},
+	} {
+		*field.dst, err = parseMinuteOfDay(field.value)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`Times must look like 20:30.`))
+			return
+		}
+	}
+
+	_, err = api.db.Exec(`INSERT INTO reminder_settings (user_id, enabled, remind_at, quiet_start, quiet_end)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE SET enabled = $2, remind_at = $3, quiet_start = $4, quiet_end = $5, updated_at = now()`,
+		userID, s.Enabled, s.RemindAt, s.QuietStart, s.QuietEnd)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
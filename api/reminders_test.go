@@ -0,0 +1,45 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReminderDue(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2020, 3, 16, hour, minute, 0, 0, time.UTC)
+	}
+	evening := reminderSettings{Enabled: true, RemindAt: 20 * 60}
+	quietNight := reminderSettings{Enabled: true, RemindAt: 21 * 60, QuietStart: 22 * 60, QuietEnd: 7 * 60}
+
+	cases := []struct {
+		now      time.Time
+		settings reminderSettings
+		due      bool
+	}{
+		{at(19, 59), evening, false},
+		{at(20, 0), evening, true},
+		{at(22, 59), evening, true},
+		{at(23, 0), evening, false},
+		{at(20, 30), reminderSettings{RemindAt: 20 * 60}, false},
+		{at(21, 30), quietNight, true},
+		{at(22, 30), quietNight, false},
+	}
+	for _, c := range cases {
+		if due := reminderDue(c.now, c.settings); due != c.due {
+			t.Errorf("%s with %+v: expected %v, got %v", c.now.Format("15:04"), c.settings, c.due, due)
+		}
+	}
+}
+
+func TestInQuietHours(t *testing.T) {
+	if inQuietHours(3*60, 0, 0) {
+		t.Error("equal start and end should mean no quiet hours")
+	}
+	if !inQuietHours(23*60, 22*60, 7*60) || !inQuietHours(6*60, 22*60, 7*60) || inQuietHours(7*60, 22*60, 7*60) {
+		t.Error("quiet hours should wrap past midnight")
+	}
+	if !inQuietHours(13*60, 12*60, 14*60) || inQuietHours(14*60, 12*60, 14*60) {
+		t.Error("unexpected daytime quiet hours")
+	}
+}
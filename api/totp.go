@@ -0,0 +1,467 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpIssuer        = "ReadFaster"
+	numRecoveryCodes  = 10
+	loginChallengeTTL = 5 * time.Minute
+	// loginChallengeCookie holds the challenge between the login steps.
+	loginChallengeCookie = "rfa_login_challenge"
+	maxLoginAttempts     = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func totpURI(secret, email string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+email) + "?" + v.Encode()
+}
+
+// totpCode computes the RFC 6238 code for the given time step counter.
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+// validateTOTP checks code against the time steps around t and returns the
+// matching counter. Codes from counters at or below lastCounter are rejected
+// so a code can't be replayed.
+func validateTOTP(secret, code string, t time.Time, lastCounter int64) (int64, bool) {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := t.Unix() / totpPeriod
+	for _, counter := range []int64{current - 1, current, current + 1} {
+		if counter <= lastCounter {
+			continue
+		}
+		expected, err := totpCode(secret, counter)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+func generateRecoveryCodes() ([]string, error) {
+	codes := []string{}
+	for i := 0; i < numRecoveryCodes; i++ {
+		b := make([]byte, 5)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	return codes, nil
+}
+
+func (api *API) HandleAPIPostTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	email := ""
+	enabled := false
+	err := api.db.QueryRow("SELECT email, totp_enabled FROM users WHERE id = $1", userID).Scan(&email, &enabled)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`Two-factor authentication is already enabled.`))
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The secret stays pending until it's confirmed with a valid code.
+	_, err = api.db.Exec("UPDATE users SET totp_secret = $1, totp_last_counter = 0 WHERE id = $2", secret, userID)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"secret": secret,
+		"uri":    totpURI(secret, email),
+	})
+}
+
+func (api *API) HandleAPIPostTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	requestBody := struct {
+		Code string `json:"code"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	secret := ""
+	enabled := false
+	err = api.db.QueryRow("SELECT totp_secret, totp_enabled FROM users WHERE id = $1", userID).Scan(&secret, &enabled)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`Two-factor authentication is already enabled.`))
+		return
+	}
+	if secret == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Start enrollment first.`))
+		return
+	}
+
+	counter, ok := validateTOTP(secret, requestBody.Code, time.Now(), 0)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`Invalid code.`))
+		return
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := api.db.Begin()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("UPDATE users SET totp_enabled = true, totp_last_counter = $1 WHERE id = $2", counter, userID)
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for _, code := range codes {
+		_, err = tx.Exec("INSERT INTO totp_recovery_codes (user_id, code) VALUES ($1, crypt($2, gen_salt('bf')))", userID, code)
+		if err != nil {
+			tx.Rollback()
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	api.audit(r, userID, auditTOTPEnabled, "")
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+func (api *API) HandleAPIDeleteTOTP(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	requestBody := struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ok, err := api.verifySecondFactor(userID, requestBody.Code, requestBody.RecoveryCode)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`Invalid code.`))
+		return
+	}
+
+	tx, err := api.db.Begin()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("UPDATE users SET totp_enabled = false, totp_secret = '', totp_last_counter = 0 WHERE id = $1", userID)
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	api.audit(r, userID, auditTOTPDisabled, "")
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// HandleAPILoginTOTP is the second login step for users with two-factor
+// authentication enabled. It exchanges the login challenge cookie and a
+// valid code for an auth session.
+func (api *API) HandleAPILoginTOTP(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	challengeCookie, err := r.Cookie(loginChallengeCookie)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`Login expired. Please log in again.`))
+		return
+	}
+	challenge := challengeCookie.Value
+
+	if !api.checkRateLimits(w, rateLimitCheck{loginIPLimit, api.clientIP(r)}) {
+		return
+	}
+
+	// Count the attempt up front so a challenge can't be brute forced.
+	userID := ""
+	remember := false
+	err = api.db.QueryRow(`UPDATE login_challenges SET attempts = attempts + 1
+		WHERE id = $1 AND expires_at > now() AND attempts < $2 RETURNING user_id, remember`,
+		challenge, maxLoginAttempts).Scan(&userID, &remember)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`Login expired. Please log in again.`))
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ok, err := api.verifySecondFactor(userID, requestBody.Code, requestBody.RecoveryCode)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		err = api.recordLoginFailure(userID)
+		if err != nil {
+			log.Println(err)
+		}
+		api.audit(r, userID, auditLoginFailed, "totp")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`Invalid code.`))
+		return
+	}
+
+	_, err = api.db.Exec("DELETE FROM login_challenges WHERE id = $1", challenge)
+	if err != nil {
+		log.Println(err)
+	}
+	api.setLoginChallengeCookie(w, "", -1)
+
+	err = api.createAuthSession(w, userID, remember)
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	err = api.resetLoginFailures(userID)
+	if err != nil {
+		log.Println(err)
+	}
+	if requestBody.RecoveryCode != "" {
+		api.audit(r, userID, auditLogin, "recovery_code")
+	} else {
+		api.audit(r, userID, auditLogin, "totp")
+	}
+}
+
+// verifySecondFactor checks either a TOTP code or an unused recovery code for
+// the user. Recovery codes are consumed on success.
+func (api *API) verifySecondFactor(userID, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		result, err := api.db.Exec(`UPDATE totp_recovery_codes SET used_at = now()
+			WHERE user_id = $1 AND used_at IS NULL AND code = crypt($2, code)`,
+			userID, strings.ToLower(strings.TrimSpace(recoveryCode)))
+		if err != nil {
+			return false, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		return n > 0, nil
+	}
+
+	secret := ""
+	lastCounter := int64(0)
+	err := api.db.QueryRow("SELECT totp_secret, totp_last_counter FROM users WHERE id = $1 AND totp_enabled",
+		userID).Scan(&secret, &lastCounter)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	counter, ok := validateTOTP(secret, code, time.Now(), lastCounter)
+	if !ok {
+		return false, nil
+	}
+
+	// Only one login can use a given code.
+	result, err := api.db.Exec("UPDATE users SET totp_last_counter = $1 WHERE id = $2 AND totp_last_counter < $1",
+		counter, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// createLoginChallenge starts the second login step for userID and sets the
+// challenge cookie. remember is carried over to the session created once
+// the step is complete.
+func (api *API) createLoginChallenge(w http.ResponseWriter, userID string, remember bool) error {
+	challenge := ""
+	err := api.db.QueryRow(`INSERT INTO login_challenges (id, user_id, expires_at, remember)
+		VALUES (encode(gen_random_bytes(16), 'hex'), $1, now()+$2::interval, $3) RETURNING id`,
+		userID, fmtInterval(loginChallengeTTL), remember).Scan(&challenge)
+	if err != nil {
+		return err
+	}
+	api.setLoginChallengeCookie(w, challenge, loginChallengeTTL)
+	return nil
+}
+
+// setLoginChallengeCookie keeps the challenge out of URLs, where it would
+// end up in history and Referer headers, and out of reach of scripts. A
+// negative ttl clears the cookie.
+func (api *API) setLoginChallengeCookie(w http.ResponseWriter, challenge string, ttl time.Duration) {
+	maxAge := int(ttl / time.Second)
+	if ttl < 0 {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginChallengeCookie,
+		Value:    challenge,
+		Path:     "/api/login",
+		MaxAge:   maxAge,
+		Secure:   !api.devMode,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
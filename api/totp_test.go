@@ -0,0 +1,99 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 test secret "12345678901234567890".
+const rfcTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, c := range cases {
+		code, err := totpCode(rfcTOTPSecret, c.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != c.code {
+			t.Errorf("expected %s at %d, got %s", c.code, c.unix, code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	counter, ok := validateTOTP(rfcTOTPSecret, "081804", now, 0)
+	if !ok {
+		t.Fatal("expected code to be valid")
+	}
+	if _, ok := validateTOTP(rfcTOTPSecret, "081804", now, counter); ok {
+		t.Error("expected replayed code to be rejected")
+	}
+	if _, ok := validateTOTP(rfcTOTPSecret, "081804", now.Add(5*time.Minute), 0); ok {
+		t.Error("expected stale code to be rejected")
+	}
+	if _, ok := validateTOTP(rfcTOTPSecret, "000000", now, 0); ok {
+		t.Error("expected wrong code to be rejected")
+	}
+}
+
+func TestTOTPFailuresEscalateLockout(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	api := &API{db: db, verifier: noopVerifier{}, devMode: true}
+	userID := createTestUser(t, db, "reader@example.com")
+	_, err := db.Exec(`UPDATE users SET password = crypt('correct horse', gen_salt('bf')),
+		totp_enabled = true, totp_secret = $2 WHERE id = $1`, userID, rfcTOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastLock := 0.0
+	for i := 1; i <= lockoutThreshold+3; i++ {
+		// Wait out the lock without forgiving any failures.
+		_, err = db.Exec("UPDATE users SET locked_until = now() - interval '1 second' WHERE id = $1 AND locked_until IS NOT NULL", userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		api.HandleAPILogin(w, httptest.NewRequest("POST", "/api/login",
+			strings.NewReader(`{"email": "reader@example.com", "password": "correct horse"}`)))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "totp_required") {
+			t.Fatalf("round %d: expected a TOTP challenge, got %d %s", i, w.Code, w.Body)
+		}
+
+		r := httptest.NewRequest("POST", "/api/login/totp", strings.NewReader(`{"code": "not a code"}`))
+		for _, cookie := range w.Result().Cookies() {
+			r.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		api.HandleAPILoginTOTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("round %d: expected %d, got %d", i, http.StatusUnauthorized, w.Code)
+		}
+
+		lock := 0.0
+		err = db.QueryRow("SELECT COALESCE(extract(epoch from locked_until - now()), 0) FROM users WHERE id = $1",
+			userID).Scan(&lock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= lockoutThreshold && lock <= lastLock {
+			t.Errorf("round %d: expected the lock to grow past %.0fs, got %.0fs", i, lastLock, lock)
+		}
+		lastLock = lock
+	}
+}
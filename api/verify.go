@@ -0,0 +1,247 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	recaptchaVerifyURL = "https://www.google.com/recaptcha/api/siteverify"
+	turnstileVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+	hcaptchaVerifyURL  = "https://api.hcaptcha.com/siteverify"
+
+	powChallengeTTL = 10 * time.Minute
+)
+
+var (
+	errVerifyMissing = errors.New("verify: missing token")
+	errVerifyFailed  = errors.New("verify: token rejected")
+	errVerifyBot     = errors.New("verify: looks like a bot")
+)
+
+// A Verifier checks that a request was made by a human. Verify returns
+// errVerifyMissing, errVerifyFailed or errVerifyBot when the token is
+// rejected, and any other error if verification couldn't be performed.
+type Verifier interface {
+	Verify(ctx context.Context, token, remoteIP string) error
+}
+
+// NewVerifier returns the Verifier for kind: "recaptcha", "turnstile",
+// "hcaptcha", "pow" or "none".
+func NewVerifier(kind, secret string, minScore float64, powDifficulty int) (Verifier, error) {
+	switch kind {
+	case "recaptcha":
+		return &siteVerifier{url: recaptchaVerifyURL, secret: secret, minScore: minScore}, nil
+	case "turnstile":
+		return &siteVerifier{url: turnstileVerifyURL, secret: secret}, nil
+	case "hcaptcha":
+		return &siteVerifier{url: hcaptchaVerifyURL, secret: secret}, nil
+	case "pow":
+		return newPoWVerifier(secret, powDifficulty), nil
+	case "none":
+		return noopVerifier{}, nil
+	}
+	return nil, fmt.Errorf("unknown verifier %q", kind)
+}
+
+type noopVerifier struct{}
+
+func (noopVerifier) Verify(ctx context.Context, token, remoteIP string) error {
+	return nil
+}
+
+// siteVerifier works with the siteverify APIs of reCAPTCHA, Turnstile and
+// hCaptcha, which share the same request and response format.
+type siteVerifier struct {
+	url    string
+	secret string
+	// minScore is only checked if non-zero. reCAPTCHA v3 returns a score,
+	// the others don't.
+	minScore float64
+}
+
+func (v *siteVerifier) Verify(ctx context.Context, token, remoteIP string) error {
+	if token == "" {
+		return errVerifyMissing
+	}
+
+	form := url.Values{
+		"secret":   []string{v.secret},
+		"response": []string{token},
+	}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequest("POST", v.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	verifyResponse := struct {
+		Success    bool     `json:"success"`
+		Score      float64  `json:"score"`
+		ErrorCodes []string `json:"error-codes"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&verifyResponse)
+	if err != nil {
+		return err
+	}
+	log.Println("verify response:", verifyResponse)
+	if !verifyResponse.Success {
+		return errVerifyFailed
+	}
+	if v.minScore > 0 && verifyResponse.Score < v.minScore {
+		return errVerifyBot
+	}
+	return nil
+}
+
+// powVerifier is a self-hosted proof-of-work check. Clients fetch a signed
+// challenge and must find a nonce so that SHA-256("<challenge>:<nonce>")
+// starts with difficulty zero bits. Tokens have the form "<challenge>:<nonce>".
+type powVerifier struct {
+	key        []byte
+	difficulty int
+
+	lock sync.Mutex
+	used map[string]time.Time
+}
+
+func newPoWVerifier(key string, difficulty int) *powVerifier {
+	return &powVerifier{
+		key:        []byte(key),
+		difficulty: difficulty,
+		used:       map[string]time.Time{},
+	}
+}
+
+func (v *powVerifier) sign(s string) string {
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Challenge returns a new challenge of the form "<ts>.<random>.<signature>".
+func (v *powVerifier) Challenge() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	payload := fmt.Sprintf("%d.%x", time.Now().Unix(), b)
+	return payload + "." + v.sign(payload), nil
+}
+
+func (v *powVerifier) Verify(ctx context.Context, token, remoteIP string) error {
+	if token == "" {
+		return errVerifyMissing
+	}
+	colon := strings.LastIndex(token, ":")
+	if colon < 0 {
+		return errVerifyFailed
+	}
+	challenge := token[:colon]
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(v.sign(parts[0]+"."+parts[1]))) {
+		return errVerifyFailed
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Unix(ts, 0).Before(time.Now().Add(-powChallengeTTL)) {
+		return errVerifyFailed
+	}
+	if leadingZeroBits(sha256.Sum256([]byte(token))) < v.difficulty {
+		return errVerifyBot
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	now := time.Now()
+	for c, expires := range v.used {
+		if expires.Before(now) {
+			delete(v.used, c)
+		}
+	}
+	if _, ok := v.used[challenge]; ok {
+		return errVerifyFailed
+	}
+	v.used[challenge] = time.Unix(ts, 0).Add(powChallengeTTL)
+	return nil
+}
+
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// checkVerify runs the configured Verifier and writes an error response if
+// the request doesn't pass.
+func (api *API) checkVerify(w http.ResponseWriter, r *http.Request, token string) bool {
+	err := api.verifier.Verify(r.Context(), token, api.clientIP(r))
+	switch err {
+	case nil:
+		return true
+	case errVerifyMissing:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Missing verify parameter.`))
+	case errVerifyFailed:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Bad verify parameter.`))
+	case errVerifyBot:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Sorry, you seem like a bot. Please try again.`))
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`Something went wrong!`))
+	}
+	return false
+}
+
+func (api *API) HandleAPIGetVerifyChallenge(w http.ResponseWriter, r *http.Request) {
+	pow, ok := api.verifier.(*powVerifier)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	challenge, err := pow.Challenge()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("content-type", "application/json")
+	w.Header().Add("cache-control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"challenge":  challenge,
+		"difficulty": pow.difficulty,
+	})
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func fakeSiteVerifyServer(t *testing.T, secret string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("secret") != secret {
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false})
+			return
+		}
+		switch r.FormValue("response") {
+		case "human":
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "score": 0.9})
+		case "bot":
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "score": 0.1})
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false})
+		}
+	}))
+}
+
+func TestSiteVerifier(t *testing.T) {
+	server := fakeSiteVerifyServer(t, "secret")
+	defer server.Close()
+
+	recaptcha := &siteVerifier{url: server.URL, secret: "secret", minScore: 0.5}
+	turnstile := &siteVerifier{url: server.URL, secret: "secret"}
+	cases := []struct {
+		verifier Verifier
+		token    string
+		err      error
+	}{
+		{recaptcha, "human", nil},
+		{recaptcha, "bot", errVerifyBot},
+		{recaptcha, "garbage", errVerifyFailed},
+		{recaptcha, "", errVerifyMissing},
+		{turnstile, "bot", nil},
+		{&siteVerifier{url: server.URL, secret: "wrong"}, "human", errVerifyFailed},
+	}
+	for _, c := range cases {
+		err := c.verifier.Verify(context.Background(), c.token, "127.0.0.1")
+		if err != c.err {
+			t.Errorf("token %q: expected %v, got %v", c.token, c.err, err)
+		}
+	}
+}
+
+func TestPoWVerifier(t *testing.T) {
+	v := newPoWVerifier("key", 8)
+	challenge, err := v.Challenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := ""
+	for nonce := 0; ; nonce++ {
+		token = fmt.Sprintf("%s:%d", challenge, nonce)
+		if leadingZeroBits(sha256.Sum256([]byte(token))) >= 8 {
+			break
+		}
+	}
+
+	if err := v.Verify(context.Background(), token, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(context.Background(), token, ""); err != errVerifyFailed {
+		t.Errorf("expected replayed token to fail, got %v", err)
+	}
+	if err := newPoWVerifier("other", 8).Verify(context.Background(), token, ""); err != errVerifyFailed {
+		t.Errorf("expected forged challenge to fail, got %v", err)
+	}
+}
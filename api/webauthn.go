@@ -0,0 +1,715 @@
+package api
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	webauthnChallengeTTL = 5 * time.Minute
+
+	// COSE algorithm identifiers.
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+
+	authDataFlagUserPresent  = 0x01
+	authDataFlagUserVerified = 0x04
+	authDataFlagAttestedData = 0x40
+
+	// webauthnMaxBodySize is far more than any real credential needs.
+	webauthnMaxBodySize = 64 << 10
+)
+
+var (
+	errWebAuthnClientData = errors.New("webauthn: client data mismatch")
+	errWebAuthnAuthData   = errors.New("webauthn: invalid authenticator data")
+	errWebAuthnSignature  = errors.New("webauthn: invalid signature")
+)
+
+type webauthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// verifyClientData checks the type, challenge and origin of a client data JSON blob.
+func verifyClientData(raw []byte, typ, challenge, origin string) error {
+	clientData := webauthnClientData{}
+	err := json.Unmarshal(raw, &clientData)
+	if err != nil {
+		return err
+	}
+	if clientData.Type != typ ||
+		strings.TrimRight(clientData.Challenge, "=") != challenge ||
+		clientData.Origin != origin {
+		return errWebAuthnClientData
+	}
+	return nil
+}
+
+func parseAuthenticatorData(b []byte, rpID string) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, errWebAuthnAuthData
+	}
+	authData := &authenticatorData{
+		RPIDHash:  b[:32],
+		Flags:     b[32],
+		SignCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return nil, errWebAuthnAuthData
+	}
+	if authData.Flags&authDataFlagUserPresent == 0 {
+		return nil, errWebAuthnAuthData
+	}
+	if authData.Flags&authDataFlagAttestedData == 0 {
+		return authData, nil
+	}
+
+	// Attested credential data: AAGUID (16), credential ID length (2),
+	// credential ID, COSE public key.
+	rest := b[37:]
+	if len(rest) < 18 {
+		return nil, errWebAuthnAuthData
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return nil, errWebAuthnAuthData
+	}
+	authData.CredentialID = rest[:idLen]
+	rest = rest[idLen:]
+	_, after, err := cborDecode(rest)
+	if err != nil {
+		return nil, err
+	}
+	authData.PublicKey = rest[:len(rest)-len(after)]
+	return authData, nil
+}
+
+// parseAttestationObject returns the authenticator data of an attestation
+// object. Attestation statements aren't verified; we only ask for "none".
+func parseAttestationObject(b []byte) ([]byte, error) {
+	obj, _, err := cborDecode(b)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := obj.(map[interface{}]interface{})
+	if !ok {
+		return nil, errWebAuthnAuthData
+	}
+	authData, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, errWebAuthnAuthData
+	}
+	return authData, nil
+}
+
+func parseCOSEKey(b []byte) (crypto.PublicKey, error) {
+	obj, _, err := cborDecode(b)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := obj.(map[interface{}]interface{})
+	if !ok {
+		return nil, errWebAuthnAuthData
+	}
+	alg, _ := m[int64(3)].(int64)
+	switch alg {
+	case coseAlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, errWebAuthnAuthData
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errWebAuthnAuthData
+		}
+		return key, nil
+	case coseAlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errWebAuthnAuthData
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return nil, fmt.Errorf("webauthn: unsupported algorithm %d", alg)
+}
+
+// verifyAssertionSignature checks an assertion signature over
+// authData || SHA-256(clientDataJSON) with the stored COSE public key.
+func verifyAssertionSignature(coseKey, authData, clientDataJSON, signature []byte) error {
+	key, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		sig := struct{ R, S *big.Int }{}
+		_, err = asn1.Unmarshal(signature, &sig)
+		if err != nil {
+			return errWebAuthnSignature
+		}
+		if !ecdsa.Verify(key, digest[:], sig.R, sig.S) {
+			return errWebAuthnSignature
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return errWebAuthnSignature
+		}
+	}
+	return nil
+}
+
+func (api *API) webauthnRPID(r *http.Request) string {
+	u, err := url.Parse(api.origin(r))
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// createWebAuthnChallenge stores a single-use challenge. userID may be empty
+// for discoverable credential logins.
+func (api *API) createWebAuthnChallenge(userID, kind string) (string, string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(b)
+	challengeID := ""
+	err = api.db.QueryRow(`INSERT INTO webauthn_challenges (id, user_id, kind, challenge, expires_at)
+		VALUES (encode(gen_random_bytes(16), 'hex'), NULLIF($1, ''), $2, $3, now()+$4::interval) RETURNING id`,
+		userID, kind, challenge, fmtInterval(webauthnChallengeTTL)).Scan(&challengeID)
+	return challengeID, challenge, err
+}
+
+// consumeWebAuthnChallenge deletes and returns a challenge and the user it was issued for.
+func (api *API) consumeWebAuthnChallenge(challengeID, kind string) (string, string, error) {
+	userID := sql.NullString{}
+	challenge := ""
+	err := api.db.QueryRow(`DELETE FROM webauthn_challenges WHERE id = $1 AND kind = $2 AND expires_at > now()
+		RETURNING user_id, challenge`, challengeID, kind).Scan(&userID, &challenge)
+	return userID.String, challenge, err
+}
+
+func (api *API) webauthnCredentialDescriptors(userID string) ([]map[string]interface{}, error) {
+	rows, err := api.db.Query("SELECT id FROM webauthn_credentials WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	descriptors := []map[string]interface{}{}
+	for rows.Next() {
+		id := ""
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		descriptors = append(descriptors, map[string]interface{}{
+			"type": "public-key",
+			"id":   id,
+		})
+	}
+	return descriptors, rows.Err()
+}
+
+// webauthnDecoyDescriptor returns a made-up credential descriptor for
+// email. It's the same every time, like a real one would be.
+func (api *API) webauthnDecoyDescriptor(email string) map[string]interface{} {
+	id, _ := hex.DecodeString(api.signature("webauthn-decoy", strings.ToLower(email)))
+	return map[string]interface{}{
+		"type": "public-key",
+		"id":   base64.RawURLEncoding.EncodeToString(id),
+	}
+}
+
+func (api *API) HandleAPIPostWebAuthnRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	email := ""
+	err := api.db.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&email)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	excludeCredentials, err := api.webauthnCredentialDescriptors(userID)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	challengeID, challenge, err := api.createWebAuthnChallenge(userID, "register")
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"challenge_id": challengeID,
+		"publicKey": map[string]interface{}{
+			"challenge": challenge,
+			"rp": map[string]interface{}{
+				"id":   api.webauthnRPID(r),
+				"name": "ReadFaster",
+			},
+			"user": map[string]interface{}{
+				"id":          base64.RawURLEncoding.EncodeToString([]byte(userID)),
+				"name":        email,
+				"displayName": email,
+			},
+			"pubKeyCredParams": []map[string]interface{}{
+				{"type": "public-key", "alg": coseAlgES256},
+				{"type": "public-key", "alg": coseAlgRS256},
+			},
+			"timeout":     int(webauthnChallengeTTL / time.Millisecond),
+			"attestation": "none",
+			"authenticatorSelection": map[string]interface{}{
+				"residentKey":      "preferred",
+				"userVerification": "preferred",
+			},
+			"excludeCredentials": excludeCredentials,
+		},
+	})
+}
+
+func (api *API) HandleAPIPostWebAuthnRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	requestBody := struct {
+		ChallengeID       string `json:"challenge_id"`
+		Name              string `json:"name"`
+		ClientDataJSON    string `json:"client_data_json"`
+		AttestationObject string `json:"attestation_object"`
+	}{}
+	r.Body = http.MaxBytesReader(w, r.Body, webauthnMaxBodySize)
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	challengeUserID, challenge, err := api.consumeWebAuthnChallenge(requestBody.ChallengeID, "register")
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`Registration expired. Please try again.`))
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if challengeUserID != userID {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Registration expired. Please try again.`))
+		return
+	}
+
+	clientDataJSON, err := decodeBase64URL(requestBody.ClientDataJSON)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = verifyClientData(clientDataJSON, "webauthn.create", challenge, api.origin(r))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Invalid credential.`))
+		return
+	}
+
+	attestationObject, err := decodeBase64URL(requestBody.AttestationObject)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rawAuthData, err := parseAttestationObject(attestationObject)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Invalid credential.`))
+		return
+	}
+	authData, err := parseAuthenticatorData(rawAuthData, api.webauthnRPID(r))
+	if err == nil && authData.CredentialID == nil {
+		err = errWebAuthnAuthData
+	}
+	if err == nil {
+		_, err = parseCOSEKey(authData.PublicKey)
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`Invalid credential.`))
+		return
+	}
+
+	name := requestBody.Name
+	if name == "" {
+		name = "Passkey"
+	}
+	credentialID := base64.RawURLEncoding.EncodeToString(authData.CredentialID)
+	result, err := api.db.Exec(`INSERT INTO webauthn_credentials (id, user_id, name, public_key, sign_count)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING`,
+		credentialID, userID, name, authData.PublicKey, int64(authData.SignCount))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`This passkey is already registered.`))
+		return
+	}
+	api.audit(r, userID, auditPasskeyAdded, name)
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":   credentialID,
+		"name": name,
+	})
+}
+
+func (api *API) HandleAPIPostWebAuthnLoginBegin(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		Email string `json:"email"`
+	}{}
+	r.Body = http.MaxBytesReader(w, r.Body, webauthnMaxBodySize)
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	checks := []rateLimitCheck{{loginIPLimit, api.clientIP(r)}}
+	if requestBody.Email != "" {
+		checks = append(checks, rateLimitCheck{loginEmailLimit, requestBody.Email})
+	}
+	if !api.checkRateLimits(w, checks...) {
+		return
+	}
+
+	// Without an email address the browser offers its discoverable credentials.
+	allowCredentials := []map[string]interface{}{}
+	userID := ""
+	if requestBody.Email != "" {
+		err = api.db.QueryRow("SELECT id FROM users WHERE email = $1", requestBody.Email).Scan(&userID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if userID != "" {
+			allowCredentials, err = api.webauthnCredentialDescriptors(userID)
+			if err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		// Unknown accounts and accounts without passkeys look like
+		// accounts with one, so the response doesn't give them away.
+		if len(allowCredentials) == 0 {
+			allowCredentials = []map[string]interface{}{api.webauthnDecoyDescriptor(requestBody.Email)}
+		}
+	}
+
+	challengeID, challenge, err := api.createWebAuthnChallenge(userID, "login")
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"challenge_id": challengeID,
+		"publicKey": map[string]interface{}{
+			"challenge":        challenge,
+			"rpId":             api.webauthnRPID(r),
+			"timeout":          int(webauthnChallengeTTL / time.Millisecond),
+			"userVerification": "preferred",
+			"allowCredentials": allowCredentials,
+		},
+	})
+}
+
+func (api *API) HandleAPIPostWebAuthnLoginFinish(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		ChallengeID       string `json:"challenge_id"`
+		ID                string `json:"id"`
+		ClientDataJSON    string `json:"client_data_json"`
+		AuthenticatorData string `json:"authenticator_data"`
+		Signature         string `json:"signature"`
+		Remember          *bool  `json:"remember"`
+	}{}
+	r.Body = http.MaxBytesReader(w, r.Body, webauthnMaxBodySize)
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !api.checkRateLimits(w, rateLimitCheck{loginIPLimit, api.clientIP(r)}) {
+		return
+	}
+
+	challengeUserID, challenge, err := api.consumeWebAuthnChallenge(requestBody.ChallengeID, "login")
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`Login expired. Please try again.`))
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	credentialID := strings.TrimRight(requestBody.ID, "=")
+	userID := ""
+	publicKey := []byte{}
+	signCount := int64(0)
+	err = api.db.QueryRow("SELECT user_id, public_key, sign_count FROM webauthn_credentials WHERE id = $1",
+		credentialID).Scan(&userID, &publicKey, &signCount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if challengeUserID != "" && challengeUserID != userID {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	clientDataJSON, err := decodeBase64URL(requestBody.ClientDataJSON)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rawAuthData, err := decodeBase64URL(requestBody.AuthenticatorData)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	signature, err := decodeBase64URL(requestBody.Signature)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = verifyClientData(clientDataJSON, "webauthn.get", challenge, api.origin(r))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	authData, err := parseAuthenticatorData(rawAuthData, api.webauthnRPID(r))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	err = verifyAssertionSignature(publicKey, rawAuthData, clientDataJSON, signature)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// Authenticators that keep a signature counter must always increase it.
+	// Anything else suggests a cloned authenticator.
+	newSignCount := int64(authData.SignCount)
+	if (newSignCount != 0 || signCount != 0) && newSignCount <= signCount {
+		log.Printf("webauthn: sign count for credential %s went from %d to %d", credentialID, signCount, newSignCount)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	result, err := api.db.Exec(`UPDATE webauthn_credentials SET sign_count = $1, last_used_at = now()
+		WHERE id = $2 AND sign_count = $3`, newSignCount, credentialID, signCount)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// With user verification (a PIN or biometric) a passkey covers both
+	// factors. A security key that only proves possession doesn't, so users
+	// with two-factor authentication still enter a code.
+	if authData.Flags&authDataFlagUserVerified == 0 {
+		totpEnabled := false
+		err = api.db.QueryRow("SELECT totp_enabled FROM users WHERE id = $1", userID).Scan(&totpEnabled)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if totpEnabled {
+			err = api.createLoginChallenge(w, userID, rememberOrDefault(requestBody.Remember))
+			if err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Add("content-type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"totp_required": true,
+			})
+			return
+		}
+	}
+
+	err = api.createAuthSession(w, userID, rememberOrDefault(requestBody.Remember))
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	api.audit(r, userID, auditLogin, "passkey")
+}
+
+func (api *API) HandleAPIGetWebAuthnCredentials(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	rows, err := api.db.Query(`SELECT id, name, extract(epoch from created_at)::BIGINT,
+		COALESCE(extract(epoch from last_used_at)::BIGINT, 0)
+		FROM webauthn_credentials WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	credentials := []map[string]interface{}{}
+	for rows.Next() {
+		id, name := "", ""
+		createdAt, lastUsedAt := int64(0), int64(0)
+		err = rows.Scan(&id, &name, &createdAt, &lastUsedAt)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		credentials = append(credentials, map[string]interface{}{
+			"id":           id,
+			"name":         name,
+			"created_at":   createdAt,
+			"last_used_at": lastUsedAt,
+		})
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(credentials)
+}
+
+func (api *API) HandleAPIDeleteWebAuthnCredential(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(userIDContextKey)
+	if userIDVal == nil {
+		log.Println("missing user ID in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userID := userIDVal.(string)
+
+	credentialID := mux.Vars(r)["credential_id"]
+
+	name := ""
+	err := api.db.QueryRow("DELETE FROM webauthn_credentials WHERE user_id = $1 AND id = $2 RETURNING name",
+		userID, credentialID).Scan(&name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	api.audit(r, userID, auditPasskeyRemoved, name)
+}
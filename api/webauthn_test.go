@@ -0,0 +1,154 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// coseES256Key encodes {1: 2, 3: -7, -1: 1, -2: x, -3: y}.
+func coseES256Key(key *ecdsa.PublicKey) []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	b := []byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01}
+	b = append(b, 0x21, 0x58, 0x20)
+	b = append(b, x...)
+	b = append(b, 0x22, 0x58, 0x20)
+	return append(b, y...)
+}
+
+func testAuthData(rpID string, flags byte, signCount uint32, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	b := append([]byte{}, rpIDHash[:]...)
+	b = append(b, flags)
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, signCount)
+	b = append(b, count...)
+	return append(b, attested...)
+}
+
+func TestParseAuthenticatorDataAttested(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := []byte("credential-id")
+	attested := make([]byte, 16)
+	attested = append(attested, 0, byte(len(credentialID)))
+	attested = append(attested, credentialID...)
+	attested = append(attested, coseES256Key(&key.PublicKey)...)
+
+	authData, err := parseAuthenticatorData(testAuthData("www.readfaster.app",
+		authDataFlagUserPresent|authDataFlagAttestedData, 1, attested), "www.readfaster.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(authData.CredentialID) != "credential-id" {
+		t.Errorf("unexpected credential ID %q", authData.CredentialID)
+	}
+	if _, err := parseCOSEKey(authData.PublicKey); err != nil {
+		t.Error(err)
+	}
+
+	_, err = parseAuthenticatorData(testAuthData("evil.example",
+		authDataFlagUserPresent, 1, nil), "www.readfaster.app")
+	if err == nil {
+		t.Error("expected RP ID mismatch to fail")
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDataJSON, _ := json.Marshal(webauthnClientData{
+		Type:      "webauthn.get",
+		Challenge: base64.RawURLEncoding.EncodeToString([]byte("challenge")),
+		Origin:    "https://www.readfaster.app",
+	})
+	err = verifyClientData(clientDataJSON, "webauthn.get",
+		base64.RawURLEncoding.EncodeToString([]byte("challenge")), "https://www.readfaster.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyClientData(clientDataJSON, "webauthn.get",
+		base64.RawURLEncoding.EncodeToString([]byte("challenge")), "https://phish.example")
+	if err == nil {
+		t.Error("expected origin mismatch to fail")
+	}
+
+	authData := testAuthData("www.readfaster.app", authDataFlagUserPresent, 2, nil)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coseKey := coseES256Key(&key.PublicKey)
+	if err := verifyAssertionSignature(coseKey, authData, clientDataJSON, signature); err != nil {
+		t.Fatal(err)
+	}
+	authData[len(authData)-1]++
+	if err := verifyAssertionSignature(coseKey, authData, clientDataJSON, signature); err == nil {
+		t.Error("expected tampered authenticator data to fail")
+	}
+}
+
+func TestWebAuthnLoginBeginHidesAccounts(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	api := &API{db: db, authSecret: "secret", baseURL: "https://www.readfaster.app"}
+	createTestUser(t, db, "reader@example.com")
+
+	allowCredentials := func(email string) []map[string]string {
+		w := httptest.NewRecorder()
+		api.HandleAPIPostWebAuthnLoginBegin(w, httptest.NewRequest("POST", "/api/webauthn/login/begin",
+			strings.NewReader(`{"email": "`+email+`"}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected %d, got %d", email, http.StatusOK, w.Code)
+		}
+		response := struct {
+			PublicKey struct {
+				AllowCredentials []map[string]string `json:"allowCredentials"`
+			} `json:"publicKey"`
+		}{}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response.PublicKey.AllowCredentials
+	}
+
+	// An account without passkeys and an unknown one both get one stable,
+	// made-up credential.
+	known := allowCredentials("reader@example.com")
+	unknown := allowCredentials("stranger@example.com")
+	if len(known) != 1 || len(unknown) != 1 {
+		t.Errorf("expected one credential each, got %v and %v", known, unknown)
+	}
+	if again := allowCredentials("stranger@example.com"); !reflect.DeepEqual(again, unknown) {
+		t.Errorf("expected the same credential again, got %v and %v", unknown, again)
+	}
+
+	// It's rate limited like login.
+	for i := 0; i <= int(loginEmailLimit.burst); i++ {
+		w := httptest.NewRecorder()
+		api.HandleAPIPostWebAuthnLoginBegin(w, httptest.NewRequest("POST", "/api/webauthn/login/begin",
+			strings.NewReader(`{"email": "limited@example.com"}`)))
+		if i == int(loginEmailLimit.burst) && w.Code != http.StatusTooManyRequests {
+			t.Errorf("expected %d after %d attempts, got %d", http.StatusTooManyRequests, i+1, w.Code)
+		}
+	}
+}
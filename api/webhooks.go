@@ -0,0 +1,181 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// mailgunWebhookMaxAge bounds how old a signed webhook timestamp may be, so
+	// captured requests can't be replayed later.
+	mailgunWebhookMaxAge = 15 * time.Minute
+	// Tokens are kept well past the signature's max age to catch replays.
+	mailgunWebhookTokenMaxAge = 30 * 24 * time.Hour
+)
+
+// verifyMailgunSignature checks a Mailgun webhook signature, which is the
+// hex HMAC-SHA256 of timestamp+token keyed with the webhook signing key.
+func verifyMailgunSignature(key, timestamp, token, signature string) bool {
+	if key == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + token))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return false
+	}
+	return checkSignedTimestamp(timestamp, mailgunWebhookMaxAge)
+}
+
+type mailgunWebhook struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+	EventData struct {
+		Event     string  `json:"event"`
+		Severity  string  `json:"severity"`
+		Reason    string  `json:"reason"`
+		Recipient string  `json:"recipient"`
+		Timestamp float64 `json:"timestamp"`
+		Message   struct {
+			Headers struct {
+				MessageID string `json:"message-id"`
+			} `json:"headers"`
+		} `json:"message"`
+		DeliveryStatus struct {
+			Code        int    `json:"code"`
+			Message     string `json:"message"`
+			Description string `json:"description"`
+		} `json:"delivery-status"`
+	} `json:"event-data"`
+}
+
+// suppressionReason returns why an event should stop further non-essential
+// email to the recipient, or "" if it shouldn't. Temporary failures are
+// retried by Mailgun and only recorded.
+func suppressionReason(event, severity string) string {
+	switch event {
+	case "failed":
+		if severity == "permanent" {
+			return "bounce"
+		}
+	case "complained":
+		return "complaint"
+	case "unsubscribed":
+		return "unsubscribed"
+	}
+	return ""
+}
+
+// HandleMailgunWebhook records delivery, bounce and complaint events sent by
+// Mailgun and suppresses addresses that bounced or complained.
+func (api *API) HandleMailgunWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook := mailgunWebhook{}
+	err := json.NewDecoder(r.Body).Decode(&webhook)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sig := webhook.Signature
+	if !verifyMailgunSignature(api.mailgunWebhookKey, sig.Timestamp, sig.Token, sig.Signature) {
+		// Mailgun stops retrying on 406.
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+
+	event := webhook.EventData
+	if event.Recipient == "" || event.Event == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	reason := event.Reason
+	if event.DeliveryStatus.Message != "" || event.DeliveryStatus.Description != "" {
+		reason = strings.TrimSpace(strconv.Itoa(event.DeliveryStatus.Code) + " " +
+			event.DeliveryStatus.Message + " " + event.DeliveryStatus.Description)
+	}
+	occurredAt := time.Now()
+	if event.Timestamp > 0 {
+		occurredAt = time.Unix(0, int64(event.Timestamp*float64(time.Second)))
+	}
+
+	tx, err := api.db.Begin()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Each signed token is only processed once, so a captured request can't
+	// be replayed within the signature's max age. The token is only kept if
+	// the rest of the transaction commits, so Mailgun can retry failures.
+	result, err := tx.Exec("INSERT INTO mailgun_webhooks (token, timestamp) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		sig.Token, sig.Timestamp)
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+
+	_, err = tx.Exec(`INSERT INTO email_events (recipient, event, severity, reason, message_id, occurred_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`, event.Recipient, event.Event, event.Severity, reason,
+		event.Message.Headers.MessageID, occurredAt.UTC())
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	suppression := suppressionReason(event.Event, event.Severity)
+	if suppression != "" {
+		_, err = tx.Exec(`INSERT INTO email_suppressions (email, reason) VALUES (lower($1), $2)
+			ON CONFLICT (email) DO NOTHING`, event.Recipient, suppression)
+		if err != nil {
+			tx.Rollback()
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if suppression != "" {
+		log.Printf("Suppressing email to %s: %s", event.Recipient, suppression)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) sweepMailgunWebhooks() error {
+	_, err := api.db.Exec("DELETE FROM mailgun_webhooks WHERE created_at < now() - $1::interval",
+		fmtInterval(mailgunWebhookTokenMaxAge))
+	return err
+}
+
+// isSuppressed reports whether email bounced or complained before.
+func (api *API) isSuppressed(email string) (bool, error) {
+	suppressed := false
+	err := api.db.QueryRow("SELECT EXISTS (SELECT 1 FROM email_suppressions WHERE email = lower($1))",
+		email).Scan(&suppressed)
+	return suppressed, err
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signMailgun(key, timestamp, token string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyMailgunSignature(t *testing.T) {
+	now := fmt.Sprint(time.Now().Unix())
+	old := fmt.Sprint(time.Now().Add(-time.Hour).Unix())
+
+	cases := []struct {
+		key, timestamp, token, signature string
+		ok                               bool
+	}{
+		{"key", now, "token", signMailgun("key", now, "token"), true},
+		{"key", now, "token", signMailgun("other", now, "token"), false},
+		{"key", now, "token2", signMailgun("key", now, "token"), false},
+		{"key", old, "token", signMailgun("key", old, "token"), false},
+		{"", now, "token", signMailgun("", now, "token"), false},
+	}
+	for i, c := range cases {
+		if ok := verifyMailgunSignature(c.key, c.timestamp, c.token, c.signature); ok != c.ok {
+			t.Errorf("case %d: expected %v, got %v", i, c.ok, ok)
+		}
+	}
+}
+
+func TestSuppressionReason(t *testing.T) {
+	cases := []struct {
+		event, severity, reason string
+	}{
+		{"delivered", "", ""},
+		{"failed", "temporary", ""},
+		{"failed", "permanent", "bounce"},
+		{"complained", "", "complaint"},
+	}
+	for _, c := range cases {
+		if reason := suppressionReason(c.event, c.severity); reason != c.reason {
+			t.Errorf("%s/%s: expected %q, got %q", c.event, c.severity, c.reason, reason)
+		}
+	}
+}
+
+func TestMailgunWebhookRejectsReplays(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	api := &API{db: db, mailgunWebhookKey: "key"}
+
+	now := fmt.Sprint(time.Now().Unix())
+	body := fmt.Sprintf(`{"signature": {"timestamp": %q, "token": "token", "signature": %q},
+		"event-data": {"event": "complained", "recipient": "reader@example.com"}}`, now, signMailgun("key", now, "token"))
+	post := func() int {
+		w := httptest.NewRecorder()
+		api.HandleMailgunWebhook(w, httptest.NewRequest("POST", "/webhooks/mailgun", strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := post(); code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, code)
+	}
+	if code := post(); code != http.StatusNotAcceptable {
+		t.Errorf("expected replay to get %d, got %d", http.StatusNotAcceptable, code)
+	}
+	if n := countRows(t, db, "SELECT count(*) FROM email_events"); n != 1 {
+		t.Errorf("expected 1 event, got %d", n)
+	}
+	if n := countRows(t, db, "SELECT count(*) FROM email_suppressions WHERE email = 'reader@example.com'"); n != 1 {
+		t.Errorf("expected 1 suppression, got %d", n)
+	}
+}
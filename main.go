@@ -3,30 +3,87 @@ package main
 import (
 	"flag"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/Preetam/readfasterapp/api"
 )
 
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func main() {
 	listen := flag.String("listen", "127.0.0.1:8000", "Listen address")
 	dbConnectionString := flag.String("db", "", "DB connection string")
 	recaptchaSecret := flag.String("recaptcha-secret", "", "reCAPTCHA secret")
+	verifier := flag.String("verifier", "recaptcha", "Bot verification (recaptcha, turnstile, hcaptcha or pow)")
+	verifierSecret := flag.String("verifier-secret", "", "Bot verification secret (defaults to -recaptcha-secret)")
+	verifierMinScore := flag.Float64("verifier-min-score", 0.5, "Minimum reCAPTCHA v3 score")
+	powDifficulty := flag.Int("pow-difficulty", 20, "Proof-of-work difficulty in leading zero bits")
 	mailgunKey := flag.String("mailgun-key", "", "Mailgun API key")
+	mailgunDomain := flag.String("mailgun-domain", "mg.readfaster.app", "Mailgun sending domain")
+	mailgunWebhookKey := flag.String("mailgun-webhook-key", "", "Mailgun webhook signing key")
+	mailer := flag.String("mailer", "", "Mail backend: mailgun, smtp, file or log (default mailgun, or log in dev mode)")
+	smtpAddr := flag.String("smtp-addr", "", "SMTP relay host:port")
+	smtpUsername := flag.String("smtp-username", "", "SMTP username")
+	smtpPassword := flag.String("smtp-password", "", "SMTP password")
+	mailDir := flag.String("mail-dir", "mail", "Directory for the file mailer")
+	mailFrom := flag.String("mail-from", "ReadFaster <noreply@mg.readfaster.app>", "From address for emails")
+	mailReplyTo := flag.String("mail-reply-to", "Preetam <readfaster@preet.am>", "Reply-To address for emails")
 	authSecret := flag.String("auth-secret", "", "Auth secret")
 	goodreadsKey := flag.String("goodreads-key", "", "Goodreads key")
 	goodreadsSecret := flag.String("goodreads-secret", "", "Goodreads secret")
+	goodreadsURL := flag.String("goodreads-url", "https://www.goodreads.com", "Goodreads base URL")
+	baseURL := flag.String("base-url", "https://www.readfaster.app", "Public base URL")
+	sessionTTL := flag.Duration("session-ttl", 12*time.Hour, "Idle lifetime of sessions without \"remember me\"")
+	rememberSessionTTL := flag.Duration("remember-session-ttl", 7*24*time.Hour, "Idle lifetime of remembered sessions")
+	sessionMaxLifetime := flag.Duration("session-max-lifetime", 30*24*time.Hour, "Maximum lifetime of any session")
+	unverifiedAccountTTL := flag.Duration("unverified-account-ttl", 7*24*time.Hour, "Delete accounts not verified within this time (0 to disable)")
+	trustedProxies := flag.Int("trusted-proxies", 0, "Number of reverse proxies in front of the app that append to X-Forwarded-For")
+	breachedPasswordsDir := flag.String("breached-passwords-dir", "", "Directory of breached password hash range files")
+	adminEmails := flag.String("admin-emails", "", "Comma-separated emails of users to make admins")
 	devMode := flag.Bool("dev-mode", false, "Enables developer mode")
 	flag.Parse()
 
 	err := api.Run(&api.Options{
-		Listen:          *listen,
-		DBConnString:    *dbConnectionString,
-		RecaptchaSecret: *recaptchaSecret,
-		DevMode:         *devMode,
-		AuthSecret:      *authSecret,
-		GoodreadsKey:    *goodreadsKey,
-		GoodreadsSecret: *goodreadsSecret,
-		MailgunKey:      *mailgunKey,
+		Listen:           *listen,
+		DBConnString:     *dbConnectionString,
+		RecaptchaSecret:  *recaptchaSecret,
+		Verifier:         *verifier,
+		VerifierSecret:   *verifierSecret,
+		VerifierMinScore: *verifierMinScore,
+		PoWDifficulty:    *powDifficulty,
+		DevMode:          *devMode,
+		AuthSecret:       *authSecret,
+		GoodreadsKey:     *goodreadsKey,
+		GoodreadsSecret:  *goodreadsSecret,
+		GoodreadsURL:     *goodreadsURL,
+		MailgunKey:       *mailgunKey,
+		BaseURL:          *baseURL,
+		AdminEmails:      splitList(*adminEmails),
+
+		BreachedPasswordsDir: *breachedPasswordsDir,
+		Mailer:               *mailer,
+		MailgunDomain:        *mailgunDomain,
+		SMTPAddr:             *smtpAddr,
+		SMTPUsername:         *smtpUsername,
+		SMTPPassword:         *smtpPassword,
+		MailDir:              *mailDir,
+		MailFrom:             *mailFrom,
+		MailReplyTo:          *mailReplyTo,
+		MailgunWebhookKey:    *mailgunWebhookKey,
+		SessionTTL:           *sessionTTL,
+		RememberSessionTTL:   *rememberSessionTTL,
+		SessionMaxLifetime:   *sessionMaxLifetime,
+		UnverifiedAccountTTL: *unverifiedAccountTTL,
+		TrustedProxies:       *trustedProxies,
 	})
 	if err != nil {
 		log.Fatal(err)
@@ -140,6 +140,14 @@ class LoginForm extends Component {
 				} else {
 					this.setState({ error: response.status + ": " + response.statusText })
 				}
+			} else if ((response.headers.get("content-type") || "").indexOf("application/json") == 0) {
+				return response.json().then((data) => {
+					if (data.totp_required) {
+						route("/app/login/totp")
+						return
+					}
+					this.setState({ completed: true })
+				})
 			} else {
 				this.setState({
 					completed: true,
@@ -207,6 +215,69 @@ class LoginForm extends Component {
 	}
 }
 
+// TOTPForm is the second login step for users with two-factor
+// authentication. The login challenge is kept in an HttpOnly cookie.
+class TOTPForm extends Component {
+	constructor() {
+		super()
+		this.state = { code: '', useRecoveryCode: false, submitted: false, error: null }
+	}
+
+	onSubmit(e) {
+		e.preventDefault();
+
+		fetch("/api/login/totp", {
+			method: "POST",
+			headers: {
+				'Content-Type': 'application/json'
+			},
+			body: JSON.stringify(this.state.useRecoveryCode ?
+				{ recovery_code: this.state.code } :
+				{ code: this.state.code }),
+		}).then((response) => {
+			if (response.ok) {
+				window.location.href = "/app";
+				return
+			}
+			return response.text().then((text) => {
+				this.setState({ submitted: false, error: text || (response.status + ": " + response.statusText) })
+			})
+		})
+		.catch(((e) => {
+			this.setState({ submitted: false, error: "Something went wrong." })
+		}).bind(this))
+
+		this.setState({ submitted: true, error: null })
+	}
+
+	onCodeInput(e) {
+		this.setState({ code: e.target.value })
+	}
+
+	toggleRecoveryCode(e) {
+		e.preventDefault();
+		this.setState({ useRecoveryCode: !this.state.useRecoveryCode, error: null })
+	}
+
+	render() {
+		return html`
+			<h3>Two-factor authentication</h3>
+			${this.state.error ? html`<p>${this.state.error}</p>` : ''}
+			<form onSubmit=${this.onSubmit.bind(this)}>
+				${this.state.useRecoveryCode ? html`
+				<input class='rfa-input' type=text name=recovery_code autocomplete=off placeholder='Recovery code' onInput=${this.onCodeInput.bind(this)}></input>
+				` : html`
+				<input class='rfa-input' type=text name=code inputmode=numeric autocomplete=one-time-code placeholder='Authentication code' onInput=${this.onCodeInput.bind(this)}></input>
+				`}
+				<button class='rfa-button' type="submit" disabled=${this.state.submitted}>Verify</button>
+			</form>
+			<p><a href='#' onclick=${this.toggleRecoveryCode.bind(this)}>
+				${this.state.useRecoveryCode ? 'Use your authenticator app instead.' : 'Lost your device? Use a recovery code.'}
+			</a></p>
+		`
+	}
+}
+
 class Register extends Component {
 	render() {
 		return html`
@@ -284,6 +355,7 @@ class App extends Component {
 			<${Goodreads} path="/app/goodreads" />
 			<${Register} path="/app/register" />
 			<${Login} path="/app/login" />
+			<${TOTPForm} path="/app/login/totp" />
 			<${Profile} path="/app/profile" userEmail=${this.state.userEmail} />
 			<${Help} path="/app/help" />
 		</${Router}>
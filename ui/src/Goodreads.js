@@ -67,6 +67,7 @@ class Goodreads extends Component {
 		this.state = {
 			loading: true,
 			error: null,
+			broken: false,
 			books: [],
 			modalBook: null,
 		}
@@ -84,6 +85,10 @@ class Goodreads extends Component {
 			this.setState({ loading: false, books: data.books });
 		}).bind(this))
 		.catch(((e) => {
+			if (e.status == 409) {
+				this.setState({ loading: false, broken: true })
+				return
+			}
 			this.setState({ loading: false, error: e.status + ": " + e.statusText })
 		}).bind(this))
 	}
@@ -103,6 +108,11 @@ class Goodreads extends Component {
 				<p>Loading...</p>
 			`
 		}
+		if (this.state.broken) {
+			return html`
+				<p>Your Goodreads connection stopped working. <a href="/goodreads/auth">Reconnect it.</a></p>
+			`
+		}
 		if (this.state.error) {
 			return html`
 				<p>Something went wrong: ${this.state.error}</p>
@@ -131,6 +141,7 @@ class Goodreads extends Component {
 									${b.progress.page > 0 ? html`Page ${b.progress.page} of ${b.num_pages}` :
 									html`${b.progress.percent}%`}
 								</strong> - ` : ''}
+								${b.progress_unavailable ? html`Progress unavailable - ` : ''}
 								<a href='#' onclick=${() => (setModalBook(b))}>Update progress</a>
 							</div>
 						</div>